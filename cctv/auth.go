@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"streamdeckd-modules/internal/secret"
+)
+
+const defaultTokenRefresh = time.Hour
+
+// cameraAuth is how requests to a camera authenticate. The password and token
+// may be references to where they are stored, which are resolved on each
+// request.
+type cameraAuth struct {
+	// Kind is "basic", "digest", "bearer", or empty for none
+	Kind     string
+	Username string
+	Password string
+	Token    string
+	Headers  http.Header
+	// TokenUrl, if set, is fetched for a short lived token, which is sent as
+	// the bearer token, or otherwise added to the query as TokenParam. It is
+	// fetched again every TokenRefresh, or once the camera refuses it.
+	TokenUrl     string
+	TokenParam   string
+	TokenField   string
+	TokenRefresh time.Duration
+
+	lock       sync.Mutex
+	challenge  *digestChallenge
+	nonceCount int
+	token      string
+	tokenAt    time.Time
+}
+
+func authFromFields(fields map[string]any) *cameraAuth {
+	a := &cameraAuth{
+		TokenParam:   "token",
+		TokenRefresh: durationField(fields["token_refresh"], defaultTokenRefresh),
+		Headers:      make(http.Header),
+	}
+	a.Kind, _ = fields["auth"].(string)
+	if a.Kind == "none" {
+		a.Kind = ""
+	}
+	a.Username, _ = fields["username"].(string)
+	a.Password, _ = fields["password"].(string)
+	a.Token, _ = fields["token"].(string)
+	a.TokenUrl, _ = fields["token_url"].(string)
+	a.TokenField, _ = fields["token_field"].(string)
+	if param, ok := fields["token_param"].(string); ok && param != "" {
+		a.TokenParam = param
+	}
+	if headers, ok := fields["headers"].(string); ok {
+		// Only new lines separate headers, as values such as Accept or Cookie
+		// can hold commas
+		for _, line := range strings.Split(headers, "\n") {
+			name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+			if !ok {
+				continue
+			}
+			a.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+	return a
+}
+
+// get requests a camera URL, returning the response if it succeeded.
+func (a *cameraAuth) get(ctx context.Context, rawUrl string) (*http.Response, error) {
+	if a == nil {
+		a = &cameraAuth{}
+	}
+	response, err := a.do(ctx, rawUrl, true)
+	if err == nil && a.TokenUrl != "" && (response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden) {
+		// The token has expired early
+		response.Body.Close()
+		a.expireToken()
+		response, err = a.do(ctx, rawUrl, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 200 {
+		response.Body.Close()
+		return nil, fmt.Errorf("Couldn't get Image from URL: %s", response.Status)
+	}
+	return response, nil
+}
+
+// do sends a GET, answering a Digest challenge if the camera sends one.
+func (a *cameraAuth) do(ctx context.Context, rawUrl string, withToken bool) (*http.Response, error) {
+	response, err := a.send(ctx, rawUrl, withToken)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || a.Kind != "digest" {
+		return response, err
+	}
+	challenge, ok := parseDigestChallenge(response.Header.Values("WWW-Authenticate"))
+	if !ok {
+		return response, nil
+	}
+	response.Body.Close()
+	a.lock.Lock()
+	a.challenge = challenge
+	a.nonceCount = 0
+	a.lock.Unlock()
+	return a.send(ctx, rawUrl, withToken)
+}
+
+func (a *cameraAuth) send(ctx context.Context, rawUrl string, withToken bool) (*http.Response, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	var token string
+	if withToken && a.TokenUrl != "" {
+		token, err = a.currentToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if a.Kind != "bearer" {
+			query := u.Query()
+			query.Set(a.TokenParam, token)
+			u.RawQuery = query.Encode()
+		}
+	} else if a.Kind == "bearer" {
+		token, err = secret.Resolve(a.Token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range a.Headers {
+		req.Header[name] = values
+	}
+	switch a.Kind {
+	case "basic":
+		password, err := secret.Resolve(a.Password)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(a.Username, password)
+	case "bearer":
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	case "digest":
+		authorization, err := a.digestAuthorization(req.Method, req.URL.RequestURI())
+		if err != nil {
+			return nil, err
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+	}
+	return client.Do(req)
+}
+
+// currentToken returns the token from the token URL, fetching a new one if
+// it is too old.
+func (a *cameraAuth) currentToken(ctx context.Context) (string, error) {
+	a.lock.Lock()
+	token, fetched := a.token, a.tokenAt
+	a.lock.Unlock()
+	if token != "" && time.Since(fetched) < a.TokenRefresh {
+		return token, nil
+	}
+	response, err := a.do(ctx, a.TokenUrl, false)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return "", fmt.Errorf("Couldn't get token from %s: %s", a.TokenUrl, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	token = strings.TrimSpace(string(body))
+	if a.TokenField != "" {
+		token, err = jsonField(body, a.TokenField)
+		if err != nil {
+			return "", err
+		}
+	}
+	if token == "" {
+		return "", errors.New("empty token from " + a.TokenUrl)
+	}
+	a.lock.Lock()
+	a.token, a.tokenAt = token, time.Now()
+	a.lock.Unlock()
+	return token, nil
+}
+
+func (a *cameraAuth) expireToken() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.token = ""
+}
+
+// jsonField picks a value out of a JSON document by a dotted path, where
+// numbers index arrays, e.g. "0.value.Token.name".
+func jsonField(body []byte, path string) (string, error) {
+	var value any
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			value = v[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", errors.New("no " + path + " in token response")
+			}
+			value = v[i]
+		default:
+			return "", errors.New("no " + path + " in token response")
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", errors.New("no " + path + " in token response")
+}
+
+// digestChallenge is the WWW-Authenticate header of HTTP Digest auth (RFC
+// 7616), which most IP cameras use.
+type digestChallenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	Qop       string
+}
+
+func parseDigestChallenge(headers []string) (*digestChallenge, bool) {
+	for _, header := range headers {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		params := parseAuthParams(rest)
+		c := &digestChallenge{
+			Realm:     params["realm"],
+			Nonce:     params["nonce"],
+			Opaque:    params["opaque"],
+			Algorithm: params["algorithm"],
+		}
+		// Prefer qop=auth, as the body of a GET has nothing to protect
+		for _, qop := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(qop) == "auth" {
+				c.Qop = "auth"
+			}
+		}
+		if c.Nonce == "" {
+			continue
+		}
+		return c, true
+	}
+	return nil, false
+}
+
+// parseAuthParams splits comma separated key=value pairs, where values may be
+// quoted strings containing commas.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// digestAuthorization answers the last challenge for a request, or returns
+// nothing before the camera has sent one.
+func (a *cameraAuth) digestAuthorization(method string, uri string) (string, error) {
+	a.lock.Lock()
+	c := a.challenge
+	a.nonceCount++
+	nc := fmt.Sprintf("%08x", a.nonceCount)
+	a.lock.Unlock()
+	if c == nil {
+		return "", nil
+	}
+	password, err := secret.Resolve(a.Password)
+	if err != nil {
+		return "", err
+	}
+	var newHash func() hash.Hash
+	algorithm := strings.ToUpper(c.Algorithm)
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", errors.New("unsupported digest algorithm: " + c.Algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	nonce := make([]byte, 8)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(nonce)
+	ha1 := h(a.Username + ":" + c.Realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + c.Nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	var response string
+	if c.Qop == "" {
+		response = h(ha1 + ":" + c.Nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + c.Nonce + ":" + nc + ":" + cnonce + ":" + c.Qop + ":" + ha2)
+	}
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, a.Username, c.Realm, c.Nonce, uri, response)
+	if c.Algorithm != "" {
+		header += ", algorithm=" + c.Algorithm
+	}
+	if c.Opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, c.Opaque)
+	}
+	if c.Qop != "" {
+		header += fmt.Sprintf(", qop=%s, nc=%s, cnonce=\"%s\"", c.Qop, nc, cnonce)
+	}
+	return header, nil
+}
@@ -1,79 +1,92 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"image"
 	"log"
-	"net/http"
+	"sync"
 	"time"
 
 	"github.com/unix-streamdeck/api/v2"
 	"golang.org/x/sync/semaphore"
+	"streamdeckd-modules/internal/number"
 )
 
 type CCTVIconHandler struct {
-	Status   bool
-	Running  bool
-	Lock     *semaphore.Weighted
-	Callback func(image image.Image)
-	Quit     chan bool
-	Url      string
+	Status bool
+	feed
+
+	// grid is the shared feed while the key is part of a grid
+	gridLock sync.Mutex
+	grid     *gridFeed
 }
 
 func (c *CCTVIconHandler) Start(k api.KeyConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
-	c.Running = true
-	if c.Lock == nil {
-		c.Lock = semaphore.NewWeighted(1)
+	url, ok := k.IconHandlerFields["url"].(string)
+	if !ok || url == "" {
+		log.Println("Missing fields: url")
+		c.SetRunning(false)
+		return
 	}
-	if c.Quit == nil {
-		c.Quit = make(chan bool)
+	if c.Callback != nil {
+		callback = c.Callback
 	}
-	if c.Callback == nil {
-		c.Callback = callback
+	c.leaveGrid()
+	g, inGrid, err := gridFromFields(k.IconHandlerFields)
+	if err != nil {
+		log.Println(err)
 	}
-	url, ok := k.IconHandlerFields["url"]
-	if !ok {
-		log.Println("Missing fields: url")
-		c.Quit <- true
-		c.Running = false
+	if !inGrid {
+		c.start(k.IconHandlerFields, url, info.IconSize, info.IconSize, callback)
 		return
 	}
-	c.Url = url.(string)
-	go c.loop()
+	// The shared feed draws the key, so this key's own feed isn't started
+	c.feed.Stop()
+	c.lifecycle.Lock()
+	c.Callback = callback
+	c.Running = true
+	c.lifecycle.Unlock()
+	width, height := g.canvas(info.IconSize)
+	key := gridFeedKey(k.IconHandlerFields, url, g, info.IconSize)
+	grid := joinGrid(c, key, k.IconHandlerFields, url, width, height, g.tile(info.IconSize), callback)
+	c.gridLock.Lock()
+	c.grid = grid
+	c.gridLock.Unlock()
 }
 
-func (c *CCTVIconHandler) loop() {
-	for {
-		select {
-		case <-c.Quit:
-			return
-		default:
-			c.updateIcon()
-			time.Sleep(250 * time.Millisecond)
-		}
+// activeFeed is the feed drawing the key, its own or its grid's.
+func (c *CCTVIconHandler) activeFeed() *feed {
+	c.gridLock.Lock()
+	defer c.gridLock.Unlock()
+	if c.grid != nil {
+		return &c.grid.feed
 	}
+	return &c.feed
 }
 
-func (c *CCTVIconHandler) updateIcon() {
-	img, err := getImage(c.Url)
-	if err != nil {
-		log.Println(err)
-		return
+func (c *CCTVIconHandler) leaveGrid() {
+	c.gridLock.Lock()
+	grid := c.grid
+	c.grid = nil
+	c.gridLock.Unlock()
+	if grid != nil {
+		grid.leave(c)
 	}
-	c.Callback(img)
-}
-
-func (c *CCTVIconHandler) IsRunning() bool {
-	return c.Running
 }
 
 func (c *CCTVIconHandler) SetRunning(running bool) {
-	c.Running = running
+	c.feed.SetRunning(running)
+	c.gridLock.Lock()
+	grid := c.grid
+	c.gridLock.Unlock()
+	if grid != nil {
+		grid.setRunning(c, running)
+	}
 }
 
 func (c *CCTVIconHandler) Stop() {
-	c.Running = false
-	c.Quit <- true
+	c.feed.Stop()
+	c.leaveGrid()
 }
 
 type CCTVKeyHandler struct{}
@@ -83,37 +96,88 @@ func (CCTVKeyHandler) Key(key api.KeyConfigV3, info api.StreamDeckInfoV1) {
 		return
 	}
 	handler := key.IconHandlerStruct.(*CCTVIconHandler)
-	handler.updateIcon()
+	// Bounded, as the URL may be a stream that never ends
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	feed := handler.activeFeed()
+	_, err := feed.fetch(ctx, feed.source(), func() {})
+	if err != nil && ctx.Err() == nil {
+		log.Println(err)
+	}
 }
 
 func GetModule() api.Module {
 
 	return api.Module{
-		Name:    "CCTV",
-		NewIcon: func() api.IconHandler { return &CCTVIconHandler{Running: true, Lock: semaphore.NewWeighted(1)} },
-		IconFields: []api.Field{
+		Name: "CCTV",
+		NewIcon: func() api.IconHandler {
+			return &CCTVIconHandler{feed: feed{Running: true, Lock: semaphore.NewWeighted(1)}}
+		},
+		IconFields: append(append(append(append([]api.Field{
 			{Title: "URL", Name: "url", Type: api.Text},
+		}, cameraFields...), imageFields...), indicatorFields...), gridFields...),
+		NewLcd: func() api.LcdHandler {
+			return &CCTVLcdHandler{feed: feed{Running: true, Lock: semaphore.NewWeighted(1)}}
 		},
+		LcdFields: append(append(append([]api.Field{
+			{Title: "URLs (one per line)", Name: "url", Type: api.Text},
+			{Title: "Layout", Name: "layout", Type: api.Select, ListItems: []string{"segment", "strip"}},
+			{Title: "Segment (0 = left)", Name: "segment", Type: api.Number},
+			{Title: "Snapshot Directory", Name: "snapshot_dir", Type: api.Text},
+			{Title: "Font", Name: "font_face", Type: api.FontFace},
+		}, cameraFields...), imageFields...), indicatorFields...),
+		NewKnobOrTouch: func() api.KnobOrTouchHandler { return &CCTVKnobOrTouchHandler{} },
 	}
 }
 
-func getImage(url string) (image.Image, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	client := &http.Client{}
-	response, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if response.StatusCode != 200 {
-		return nil, errors.New("Couldn't get Image from URL")
-	}
-	defer response.Body.Close()
-	img, _, err := image.Decode(response.Body)
-	if err != nil {
-		return nil, err
+// cameraFields are how the icon and LCD handlers reach a camera.
+var cameraFields = []api.Field{
+	{Title: "Interval (Seconds)", Name: "interval", Type: api.Number},
+	{Title: "Timeout (Seconds)", Name: "timeout", Type: api.Number},
+	{Title: "Auth", Name: "auth", Type: api.Select, ListItems: []string{"none", "basic", "digest", "bearer"}},
+	{Title: "Username", Name: "username", Type: api.Text},
+	{Title: "Password", Name: "password", Type: api.Text},
+	{Title: "Token", Name: "token", Type: api.Text},
+	{Title: "Headers", Name: "headers", Type: api.Text},
+	{Title: "Token URL", Name: "token_url", Type: api.Text},
+	{Title: "Token Param", Name: "token_param", Type: api.Text},
+	{Title: "Token Field", Name: "token_field", Type: api.Text},
+	{Title: "Token Refresh (Seconds)", Name: "token_refresh", Type: api.Number},
+}
+
+// imageFields are how the icon and LCD handlers process frames.
+var imageFields = []api.Field{
+	{Title: "Crop (x,y,w,h %)", Name: "crop", Type: api.Text},
+	{Title: "Rotate", Name: "rotate", Type: api.Select, ListItems: []string{"0", "90", "180", "270"}},
+	{Title: "Flip", Name: "flip", Type: api.Select, ListItems: []string{"none", "horizontal", "vertical", "both"}},
+	{Title: "Fit", Name: "fit", Type: api.Select, ListItems: []string{"fit", "fill", "stretch"}},
+	{Title: "Grayscale", Name: "grayscale", Type: api.Select, ListItems: []string{"false", "true"}},
+	{Title: "Brightness (%)", Name: "brightness", Type: api.Number},
+}
+
+// indicatorFields warn when the picture isn't live.
+var indicatorFields = []api.Field{
+	{Title: "Timestamp", Name: "timestamp", Type: api.Select, ListItems: []string{"none", "time", "age"}},
+	{Title: "Stale After (Seconds)", Name: "stale_after", Type: api.Number},
+	{Title: "Offline After (Failures)", Name: "offline_after", Type: api.Number},
+}
+
+// gridFields span one camera across a rectangle of keys.
+var gridFields = []api.Field{
+	{Title: "Grid Columns", Name: "grid_cols", Type: api.Number},
+	{Title: "Grid Rows", Name: "grid_rows", Type: api.Number},
+	{Title: "Grid Column (Top Left)", Name: "grid_x", Type: api.Number},
+	{Title: "Grid Row (Top Left)", Name: "grid_y", Type: api.Number},
+	{Title: "Key Column", Name: "key_x", Type: api.Number},
+	{Title: "Key Row", Name: "key_y", Type: api.Number},
+	{Title: "Key Gap (% of Key)", Name: "key_gap", Type: api.Number},
+}
+
+// durationField reads a number of seconds, which may be fractional.
+func durationField(value any, fallback time.Duration) time.Duration {
+	seconds, ok := number.Field(value)
+	if !ok || seconds <= 0 {
+		return fallback
 	}
-	return img, nil
+	return time.Duration(seconds * float64(time.Second))
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultInterval = 250 * time.Millisecond
+	defaultTimeout  = 10 * time.Second
+	maxBackoff      = time.Minute
+)
+
+// client is shared by every handler, so connections to a camera are reused
+// between snapshots. Timeouts are enforced per fetch, as streams stay open
+// indefinitely.
+var client = &http.Client{}
+
+// feed fetches frames from a camera and draws them, until it is stopped. It
+// holds snapshot URLs' polling and MJPEG streams for the handlers.
+type feed struct {
+	Running  bool
+	Lock     *semaphore.Weighted
+	Callback func(image image.Image)
+	Url      string
+	// Interval is the time between snapshots, or before reopening a stream
+	Interval time.Duration
+	// Timeout is how long a snapshot, or a stream between frames, may take
+	Timeout time.Duration
+	Auth    *cameraAuth
+	Options frameOptions
+	// Width and Height are the size frames are scaled to
+	Width  int
+	Height int
+	// Overlay, if set, draws over each frame before it is shown
+	Overlay    func(img image.Image) image.Image
+	Indicators indicators
+
+	// lifecycle guards Running, and the functions that stop the loop and
+	// the current fetch
+	lifecycle  sync.Mutex
+	cancel     context.CancelFunc
+	pauseFetch context.CancelFunc
+	wake       chan struct{}
+	last       image.Image
+	// processed is the last frame scaled for the key, kept to redraw the
+	// indicators as it ages
+	processed  image.Image
+	lastAt     time.Time
+	failures   int
+	shownState string
+	shownAt    time.Time
+	// drawing keeps frames and redraws from overtaking each other
+	drawing sync.Mutex
+}
+
+// start begins fetching from the URL, replacing any earlier fetch, with the
+// settings in the fields.
+func (c *feed) start(fields map[string]any, url string, width int, height int, callback func(image image.Image)) {
+	if c.Lock == nil {
+		c.Lock = semaphore.NewWeighted(1)
+	}
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.Callback = callback
+	c.Url = url
+	c.Interval = durationField(fields["interval"], defaultInterval)
+	c.Timeout = durationField(fields["timeout"], defaultTimeout)
+	c.Auth = authFromFields(fields)
+	c.Options = frameOptionsFromFields(fields)
+	c.Indicators = indicatorsFromFields(fields)
+	c.Width, c.Height = width, height
+	// Frames from a previous camera aren't this one's
+	c.last, c.processed, c.lastAt, c.failures, c.shownState = nil, nil, time.Time{}, 0, ""
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.wake = make(chan struct{}, 1)
+	c.Running = true
+	go c.loop(ctx)
+	go c.watchIndicators(ctx)
+}
+
+// loop polls snapshot URLs, and holds MJPEG streams open, reconnecting if
+// they drop. Failures back off exponentially, up to a minute apart.
+func (c *feed) loop(ctx context.Context) {
+	// Wait for the loop of a previous Start to exit
+	err := c.Lock.Acquire(ctx, 1)
+	if err != nil {
+		return
+	}
+	defer c.Lock.Release(1)
+	src := c.source()
+	delay := src.Interval
+	for {
+		if !c.waitUntilRunning(ctx) {
+			return
+		}
+		drew, err := c.fetchOnce(ctx, src)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !drew {
+			delay = min(max(delay*2, time.Second), maxBackoff)
+			log.Printf("%v, retrying in %v", err, delay)
+			c.lifecycle.Lock()
+			c.failures++
+			c.lifecycle.Unlock()
+			c.redraw()
+		} else {
+			if err != nil {
+				log.Println(err)
+			}
+			delay = src.Interval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// source is where a loop fetches from and how, fixed for the life of the
+// loop, as a restart may change the feed's settings while it winds down.
+type source struct {
+	Url      string
+	Interval time.Duration
+	Timeout  time.Duration
+	Auth     *cameraAuth
+}
+
+func (c *feed) source() source {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	return source{Url: c.Url, Interval: c.Interval, Timeout: c.Timeout, Auth: c.Auth}
+}
+
+// waitUntilRunning blocks while the handler is paused, and reports whether it
+// should carry on.
+func (c *feed) waitUntilRunning(ctx context.Context) bool {
+	for {
+		c.lifecycle.Lock()
+		running, wake := c.Running, c.wake
+		c.lifecycle.Unlock()
+		if running {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wake:
+		}
+	}
+}
+
+// fetchOnce runs one fetch, which is cancelled if the handler is paused or
+// the camera stops answering for longer than the timeout.
+func (c *feed) fetchOnce(ctx context.Context, src source) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.lifecycle.Lock()
+	c.pauseFetch = cancel
+	c.lifecycle.Unlock()
+	var timedOut atomic.Bool
+	watchdog := time.AfterFunc(src.Timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	defer watchdog.Stop()
+	drew, err := c.fetch(ctx, src, func() { watchdog.Reset(src.Timeout) })
+	if timedOut.Load() {
+		return drew, fmt.Errorf("%s: no response in %v", src.Url, src.Timeout)
+	}
+	if ctx.Err() != nil {
+		// Paused
+		return drew, nil
+	}
+	return drew, err
+}
+
+// fetch draws a snapshot, or, for an MJPEG stream, every frame until the
+// stream ends, calling progress as data arrives. It reports whether anything
+// was drawn.
+func (c *feed) fetch(ctx context.Context, src source, progress func()) (bool, error) {
+	response, err := src.Auth.get(ctx, src.Url)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	progress()
+	if boundary, ok := isStream(response); ok {
+		return c.readStream(ctx, response.Body, boundary, progress)
+	}
+	img, _, err := image.Decode(response.Body)
+	if err != nil {
+		return false, err
+	}
+	c.draw(img)
+	return true, nil
+}
+
+// draw processes a frame for the key and shows it.
+func (c *feed) draw(img image.Image) {
+	c.lifecycle.Lock()
+	options, width, height := c.Options, c.Width, c.Height
+	c.lifecycle.Unlock()
+	frame := options.process(img, width, height)
+	c.drawing.Lock()
+	defer c.drawing.Unlock()
+	c.lifecycle.Lock()
+	c.last, c.processed, c.lastAt, c.failures = img, frame, time.Now(), 0
+	c.lifecycle.Unlock()
+	c.show()
+}
+
+// redraw shows the last frame again with up to date indicators, or the
+// offline tile.
+func (c *feed) redraw() {
+	c.drawing.Lock()
+	defer c.drawing.Unlock()
+	c.show()
+}
+
+// show draws the indicators and any overlay over the last processed frame,
+// and passes it to the callback. The drawing lock must be held.
+func (c *feed) show() {
+	c.lifecycle.Lock()
+	callback, width, height, overlay, ind := c.Callback, c.Width, c.Height, c.Overlay, c.Indicators
+	frame, at, failures := c.processed, c.lastAt, c.failures
+	c.lifecycle.Unlock()
+	state := ind.state(at, failures)
+	if frame == nil && state != "offline" {
+		return
+	}
+	frame = ind.apply(frame, state, at, width, height)
+	if overlay != nil {
+		frame = overlay(frame)
+	}
+	c.lifecycle.Lock()
+	c.shownState, c.shownAt = state, time.Now()
+	c.lifecycle.Unlock()
+	callback(frame)
+}
+
+// cropTile copies out part of a frame, so it starts at the origin as the
+// daemon expects.
+func cropTile(img image.Image, tile image.Rectangle) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, tile.Dx(), tile.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, tile.Min, draw.Src)
+	return dst
+}
+
+// lastFrame is the newest frame as the camera sent it, if there is one.
+func (c *feed) lastFrame() image.Image {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	return c.last
+}
+
+func (c *feed) IsRunning() bool {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	return c.Running
+}
+
+// SetRunning pauses fetching while the key isn't displayed, and resumes it
+// once it is.
+func (c *feed) SetRunning(running bool) {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	c.Running = running
+	if !running && c.pauseFetch != nil {
+		c.pauseFetch()
+	}
+	if running && c.wake != nil {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stop ends the loop. It never blocks, whether or not the loop is running.
+func (c *feed) Stop() {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	c.Running = false
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/number"
+)
+
+// gridLayout is a rectangle of keys sharing one camera, and where a key sits
+// in it. Columns and rows are counted from 0 at the deck's top left.
+type gridLayout struct {
+	X    int
+	Y    int
+	Cols int
+	Rows int
+	// KeyX and KeyY are the position of this key on the deck
+	KeyX int
+	KeyY int
+	// Gap is the space between two keys, as a percentage of a key
+	Gap float64
+}
+
+// gridFromFields reads the grid fields, reporting false if the key isn't part
+// of a grid.
+func gridFromFields(fields map[string]any) (gridLayout, bool, error) {
+	field := func(name string, fallback int) int {
+		value, ok := number.Field(fields[name])
+		if !ok {
+			return fallback
+		}
+		return int(value)
+	}
+	g := gridLayout{
+		X:    field("grid_x", 0),
+		Y:    field("grid_y", 0),
+		Cols: field("grid_cols", 1),
+		Rows: field("grid_rows", 1),
+		KeyX: field("key_x", 0),
+		KeyY: field("key_y", 0),
+	}
+	if gap, ok := number.Field(fields["key_gap"]); ok && gap > 0 {
+		g.Gap = gap
+	}
+	if g.Cols <= 1 && g.Rows <= 1 {
+		return g, false, nil
+	}
+	if g.Cols < 1 || g.Rows < 1 {
+		return g, false, errors.New("grid columns and rows must be at least 1")
+	}
+	column, row := g.KeyX-g.X, g.KeyY-g.Y
+	if column < 0 || row < 0 || column >= g.Cols || row >= g.Rows {
+		return g, false, fmt.Errorf("key %d,%d is outside the %dx%d grid at %d,%d", g.KeyX, g.KeyY, g.Cols, g.Rows, g.X, g.Y)
+	}
+	return g, true, nil
+}
+
+// canvas is the size the camera is scaled to, as if the keys were one screen
+// including the gaps between them, so the picture lines up across the gaps.
+func (g gridLayout) canvas(size int) (int, int) {
+	gap := g.gapPixels(size)
+	return g.Cols*size + (g.Cols-1)*gap, g.Rows*size + (g.Rows-1)*gap
+}
+
+// tile is the part of the canvas under this key.
+func (g gridLayout) tile(size int) image.Rectangle {
+	pitch := size + g.gapPixels(size)
+	x, y := (g.KeyX-g.X)*pitch, (g.KeyY-g.Y)*pitch
+	return image.Rect(x, y, x+size, y+size)
+}
+
+func (g gridLayout) gapPixels(size int) int {
+	return int(g.Gap / 100 * float64(size))
+}
+
+// gridFeed fetches a camera once for every key of a grid, or every LCD
+// segment of a touch strip, and gives each its tile of the frame, so they
+// share one connection and stay in step.
+type gridFeed struct {
+	feed
+
+	key string
+	// lock guards the keys, and the newest frame so a key joining late is
+	// drawn straight away
+	lock   sync.Mutex
+	keys   map[any]gridKey
+	canvas image.Image
+}
+
+type gridKey struct {
+	Tile     image.Rectangle
+	Callback func(image image.Image)
+	Running  bool
+}
+
+var (
+	gridsLock sync.Mutex
+	grids     = make(map[string]*gridFeed)
+)
+
+// gridFeedKey identifies keys that can share a feed: the same camera, fetched
+// and processed the same way, into the same grid.
+func gridFeedKey(fields map[string]any, url string, g gridLayout, size int) string {
+	return feedKey(fields, fmt.Sprintf("%s\n%d,%d,%d,%d,%v,%d", url, g.X, g.Y, g.Cols, g.Rows, g.Gap, size))
+}
+
+// feedKey adds the settings that change how a camera is fetched and
+// processed to what identifies a shared feed's layout.
+func feedKey(fields map[string]any, layout string) string {
+	var b strings.Builder
+	b.WriteString(layout)
+	for _, f := range append(append(append([]api.Field{}, cameraFields...), imageFields...), indicatorFields...) {
+		fmt.Fprintf(&b, "\n%v", fields[f.Name])
+	}
+	return b.String()
+}
+
+// joinGrid adds a key, or an LCD segment, to the shared feed with that feed
+// key, starting the feed at the canvas size if it is the first.
+func joinGrid(c any, key string, fields map[string]any, url string, width int, height int, tile image.Rectangle, callback func(image image.Image)) *gridFeed {
+	gridsLock.Lock()
+	defer gridsLock.Unlock()
+	grid, ok := grids[key]
+	if !ok {
+		grid = &gridFeed{key: key, keys: make(map[any]gridKey)}
+		grids[key] = grid
+		grid.start(fields, url, width, height, grid.show)
+	}
+	grid.lock.Lock()
+	grid.keys[c] = gridKey{Tile: tile, Callback: callback, Running: true}
+	canvas := grid.canvas
+	grid.lock.Unlock()
+	grid.feed.SetRunning(true)
+	if canvas != nil {
+		go callback(cropTile(canvas, tile))
+	}
+	return grid
+}
+
+// leave removes a key, stopping the feed once no keys are left.
+func (grid *gridFeed) leave(c any) {
+	gridsLock.Lock()
+	defer gridsLock.Unlock()
+	grid.lock.Lock()
+	delete(grid.keys, c)
+	left := len(grid.keys)
+	grid.lock.Unlock()
+	if left == 0 {
+		grid.feed.Stop()
+		if grids[grid.key] == grid {
+			delete(grids, grid.key)
+		}
+	}
+}
+
+// setRunning pauses a key, and the feed while none of its keys are shown.
+func (grid *gridFeed) setRunning(c any, running bool) {
+	grid.lock.Lock()
+	k, ok := grid.keys[c]
+	if ok {
+		k.Running = running
+		grid.keys[c] = k
+	}
+	shown := false
+	for _, k := range grid.keys {
+		shown = shown || k.Running
+	}
+	grid.lock.Unlock()
+	grid.feed.SetRunning(shown)
+}
+
+// show splits a frame between the keys that are shown.
+func (grid *gridFeed) show(canvas image.Image) {
+	grid.lock.Lock()
+	grid.canvas = canvas
+	keys := make([]gridKey, 0, len(grid.keys))
+	for _, k := range grid.keys {
+		if k.Running {
+			keys = append(keys, k)
+		}
+	}
+	grid.lock.Unlock()
+	for _, k := range keys {
+		k.Callback(cropTile(canvas, k.Tile))
+	}
+}
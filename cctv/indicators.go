@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/number"
+)
+
+const (
+	defaultStaleAfter   = 30 * time.Second
+	defaultOfflineAfter = 3
+	// indicatorInterval is how often the key is redrawn without a new frame,
+	// so the age and stale indicators keep up
+	indicatorInterval = time.Second
+)
+
+// indicators are how a feed warns that the picture isn't live, as a frozen
+// frame on a security camera looks just like a quiet one.
+type indicators struct {
+	// Timestamp is "time" for when the frame arrived, "age" for how long ago,
+	// or empty for neither
+	Timestamp string
+	// StaleAfter is how old a frame can get before it is greyed out with a
+	// warning, or 0 to never
+	StaleAfter time.Duration
+	// OfflineAfter is how many fetches in a row can fail before the camera is
+	// shown as offline, or 0 to keep showing the last frame
+	OfflineAfter int
+}
+
+func indicatorsFromFields(fields map[string]any) indicators {
+	i := indicators{StaleAfter: defaultStaleAfter, OfflineAfter: defaultOfflineAfter}
+	switch timestamp, _ := fields["timestamp"].(string); timestamp {
+	case "time", "age":
+		i.Timestamp = timestamp
+	}
+	if seconds, ok := number.Field(fields["stale_after"]); ok {
+		i.StaleAfter = time.Duration(max(seconds, 0) * float64(time.Second))
+	}
+	if failures, ok := number.Field(fields["offline_after"]); ok {
+		i.OfflineAfter = max(int(failures), 0)
+	}
+	return i
+}
+
+// state is "live", "stale" or "offline" for a frame from at, after a number
+// of failed fetches.
+func (i indicators) state(at time.Time, failures int) string {
+	if i.OfflineAfter > 0 && failures >= i.OfflineAfter {
+		return "offline"
+	}
+	if i.StaleAfter > 0 && !at.IsZero() && time.Since(at) > i.StaleAfter {
+		return "stale"
+	}
+	return "live"
+}
+
+// apply draws the indicators for a state over a processed frame, or replaces
+// it with the offline tile. A nil frame is only drawn once offline.
+func (i indicators) apply(frame image.Image, state string, at time.Time, width int, height int) image.Image {
+	if state == "offline" {
+		return offlineTile(frame, width, height)
+	}
+	if state == "stale" {
+		frame = badge(adjust(frame, true, -25), "Stale "+formatAge(time.Since(at)))
+	}
+	switch i.Timestamp {
+	case "time":
+		frame = caption(frame, at.Format("15:04:05"))
+	case "age":
+		if state != "stale" {
+			frame = caption(frame, formatAge(time.Since(at)))
+		}
+	}
+	return frame
+}
+
+// offlineTile is shown once a camera keeps failing, over a darkened copy of
+// the last frame if there is one.
+func offlineTile(frame image.Image, width int, height int) image.Image {
+	if frame != nil {
+		width, height = frame.Bounds().Dx(), frame.Bounds().Dy()
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: 0x40, G: 0x10, B: 0x10, A: 0xff}), image.Point{}, draw.Src)
+	if frame != nil {
+		draw.Draw(img, img.Bounds(), adjust(frame, true, -50), image.Point{}, draw.Over)
+	}
+	labelled, err := api.DrawText(img, "Camera\nOffline", api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		Colour:            "#ff4040",
+		FontSize:          int64(max(height/5, 8)),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
+
+// badge draws a warning bar across the top of a frame.
+func badge(frame image.Image, text string) image.Image {
+	return bar(frame, text, api.Top, color.NRGBA{R: 0xff, G: 0xb0, B: 0x00, A: 0xff}, "#000000")
+}
+
+// caption draws a line of text across the bottom of a frame.
+func caption(frame image.Image, text string) image.Image {
+	return bar(frame, text, api.Bottom, color.NRGBA{A: 0xa0}, "#ffffff")
+}
+
+func bar(frame image.Image, text string, alignment api.VerticalAlignment, background color.NRGBA, textColour string) image.Image {
+	b := frame.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), frame, b.Min, draw.Src)
+	height := max(b.Dy()/4, 16)
+	strip := image.Rect(0, 0, b.Dx(), height)
+	if alignment == api.Bottom {
+		strip = strip.Add(image.Pt(0, b.Dy()-height))
+	}
+	// The text is centred on its own image, as DrawText keeps a margin from
+	// the top and bottom that a thin bar doesn't have
+	label := image.NewRGBA(image.Rect(0, 0, strip.Dx(), strip.Dy()))
+	draw.Draw(label, label.Bounds(), img, strip.Min, draw.Src)
+	draw.Draw(label, label.Bounds(), image.NewUniform(background), image.Point{}, draw.Over)
+	labelled, err := api.DrawText(label, text, api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		Colour:            textColour,
+		FontSize:          int64(height * 3 / 5),
+	})
+	if err != nil {
+		log.Println(err)
+		labelled = label
+	}
+	draw.Draw(img, strip, labelled, image.Point{}, draw.Src)
+	return img
+}
+
+// formatAge is a short age, e.g. "45s", "12m" or "3h".
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return strconv.Itoa(int(age.Seconds())) + "s"
+	case age < time.Hour:
+		return strconv.Itoa(int(age.Minutes())) + "m"
+	}
+	return strconv.Itoa(int(age.Hours())) + "h"
+}
+
+// watchIndicators redraws the last frame as it ages, so the timestamp keeps
+// counting and the stale warning appears even when no new frames arrive.
+func (c *feed) watchIndicators(ctx context.Context) {
+	ticker := time.NewTicker(indicatorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.lifecycle.Lock()
+		running, ind, state, shownAt := c.Running, c.Indicators, c.shownState, c.shownAt
+		at, failures := c.lastAt, c.failures
+		c.lifecycle.Unlock()
+		if !running || time.Since(shownAt) < indicatorInterval/2 {
+			continue
+		}
+		// The stale warning shows the age too
+		if next := ind.state(at, failures); ind.Timestamp != "" || next != state || next == "stale" {
+			c.redraw()
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/number"
+)
+
+// feedbackDuration is how long the LCD shows that it switched camera or took
+// a snapshot.
+const feedbackDuration = time.Second
+
+// CCTVLcdHandler shows a camera in its LCD segment, or its part of a camera
+// spanning the whole touch strip. Turning the knob switches between the
+// cameras listed in its URL field.
+type CCTVLcdHandler struct {
+	feed
+
+	// lock guards the settings of the last Start, the camera selection, the
+	// strip's shared feed and the feedback drawn over the feed
+	lock          sync.Mutex
+	fields        map[string]any
+	info          api.StreamDeckInfoV1
+	urls          []string
+	callback      func(image image.Image)
+	selection     *cameraSelection
+	strip         *gridFeed
+	feedback      string
+	feedbackUntil time.Time
+}
+
+func (l *CCTVLcdHandler) Start(knob api.KnobConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
+	urls := splitUrls(knob.LcdHandlerFields["url"])
+	if len(urls) == 0 {
+		log.Println("Missing fields: url")
+		l.SetRunning(false)
+		return
+	}
+	l.lock.Lock()
+	l.fields = knob.LcdHandlerFields
+	l.info = info
+	l.urls = urls
+	l.callback = callback
+	if l.selection != nil {
+		l.selection.leave(l)
+	}
+	l.selection = selectionFor(urls)
+	l.lock.Unlock()
+	l.selection.join(l)
+	l.startCamera(l.selection.current())
+}
+
+// startCamera starts fetching from the selected camera, scaled to the segment.
+// In the strip layout, the segments share one feed scaled to the whole strip,
+// and each shows its own part.
+func (l *CCTVLcdHandler) startCamera(index int) {
+	l.lock.Lock()
+	fields, info, urls, callback := l.fields, l.info, l.urls, l.callback
+	l.lock.Unlock()
+	url := urls[index%len(urls)]
+	l.leaveStrip()
+	width, height := info.LcdWidth, info.LcdHeight
+	if layout, _ := fields["layout"].(string); layout != "strip" {
+		l.lifecycle.Lock()
+		l.Overlay = l.overlay
+		l.lifecycle.Unlock()
+		l.start(fields, url, width, height, callback)
+		return
+	}
+	segments := info.LcdCols
+	if segments <= 0 {
+		segments = max(info.KnobCols, 1)
+	}
+	segment, _ := number.Field(fields["segment"])
+	position := min(max(int(segment), 0), segments-1)
+	tile := image.Rect(position*width, 0, (position+1)*width, height)
+	// The shared feed draws the segment, so this segment's own feed isn't
+	// started
+	l.feed.Stop()
+	l.lifecycle.Lock()
+	l.Callback = callback
+	l.Running = true
+	l.lifecycle.Unlock()
+	key := feedKey(fields, fmt.Sprintf("strip\n%s\n%d,%d", url, width*segments, height))
+	// Feedback is only for this segment, so it is drawn over its part
+	strip := joinGrid(l, key, fields, url, width*segments, height, tile, func(img image.Image) {
+		callback(l.overlay(img))
+	})
+	l.lock.Lock()
+	l.strip = strip
+	l.lock.Unlock()
+}
+
+// activeFeed is the feed drawing the segment, its own or the strip's.
+func (l *CCTVLcdHandler) activeFeed() *feed {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.strip != nil {
+		return &l.strip.feed
+	}
+	return &l.feed
+}
+
+func (l *CCTVLcdHandler) leaveStrip() {
+	l.lock.Lock()
+	strip := l.strip
+	l.strip = nil
+	l.lock.Unlock()
+	if strip != nil {
+		strip.leave(l)
+	}
+}
+
+// setCamera switches to another camera, showing which one for a moment.
+func (l *CCTVLcdHandler) setCamera(index int) {
+	l.lock.Lock()
+	stopped := l.selection == nil
+	count := len(l.urls)
+	l.lock.Unlock()
+	if stopped {
+		return
+	}
+	l.showFeedback(fmt.Sprintf("%d/%d\n%s", index%count+1, count, cameraName(l.urlAt(index))))
+	l.startCamera(index)
+}
+
+func (l *CCTVLcdHandler) urlAt(index int) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.urls[index%len(l.urls)]
+}
+
+func (l *CCTVLcdHandler) showFeedback(text string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.feedback = text
+	l.feedbackUntil = time.Now().Add(feedbackDuration)
+}
+
+// overlay draws the feedback, if any, over a frame.
+func (l *CCTVLcdHandler) overlay(img image.Image) image.Image {
+	l.lock.Lock()
+	text, until := l.feedback, l.feedbackUntil
+	fontFace, _ := l.fields["font_face"].(string)
+	l.lock.Unlock()
+	if text == "" || time.Now().After(until) {
+		return img
+	}
+	labelled, err := api.DrawText(img, text, api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          fontFace,
+		FontSize:          int64(img.Bounds().Dy() / 5),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
+
+// snapshot saves the camera's newest frame, as it was sent, to the snapshot
+// directory.
+func (l *CCTVLcdHandler) snapshot() {
+	feed := l.activeFeed()
+	frame := feed.lastFrame()
+	if frame == nil {
+		l.showFeedback("No Frame")
+		return
+	}
+	l.lock.Lock()
+	dir, _ := l.fields["snapshot_dir"].(string)
+	l.lock.Unlock()
+	path, err := saveSnapshot(frame, dir, cameraName(feed.source().Url))
+	if err != nil {
+		log.Println(err)
+		l.showFeedback("Failed")
+		return
+	}
+	log.Println("Saved snapshot", path)
+	l.showFeedback("Saved")
+}
+
+func (l *CCTVLcdHandler) SetRunning(running bool) {
+	l.feed.SetRunning(running)
+	l.lock.Lock()
+	strip := l.strip
+	l.lock.Unlock()
+	if strip != nil {
+		strip.setRunning(l, running)
+	}
+}
+
+// Stop ends the feed, and stops following the camera selection.
+func (l *CCTVLcdHandler) Stop() {
+	l.feed.Stop()
+	l.leaveStrip()
+	l.lock.Lock()
+	selection := l.selection
+	l.selection = nil
+	l.lock.Unlock()
+	if selection != nil {
+		selection.leave(l)
+	}
+}
+
+type CCTVKnobOrTouchHandler struct{}
+
+// Input switches cameras as the knob turns, and takes a snapshot on a press
+// or tap.
+func (CCTVKnobOrTouchHandler) Input(knob api.KnobConfigV3, info api.StreamDeckInfoV1, event api.InputEvent) {
+	if knob.LcdHandler != "CCTV" {
+		return
+	}
+	handler, ok := knob.LcdHandlerStruct.(*CCTVLcdHandler)
+	if !ok {
+		return
+	}
+	handler.lock.Lock()
+	selection := handler.selection
+	handler.lock.Unlock()
+	switch event.EventType {
+	case api.KNOB_CW, api.KNOB_CCW:
+		if selection == nil {
+			return
+		}
+		notches := max(int(event.RotateNotches), 1)
+		if event.EventType == api.KNOB_CCW {
+			notches = -notches
+		}
+		selection.step(notches)
+	case api.KNOB_PRESS, api.SCREEN_SHORT_TAP:
+		go handler.snapshot()
+	}
+}
+
+// cameraSelection is the camera shown by every LCD handler with the same list
+// of URLs, so the segments of a strip switch together.
+type cameraSelection struct {
+	lock     sync.Mutex
+	key      string
+	count    int
+	index    int
+	handlers map[*CCTVLcdHandler]bool
+}
+
+var (
+	selectionsLock sync.Mutex
+	selections     = make(map[string]*cameraSelection)
+)
+
+func selectionFor(urls []string) *cameraSelection {
+	key := strings.Join(urls, "\n")
+	selectionsLock.Lock()
+	defer selectionsLock.Unlock()
+	s, ok := selections[key]
+	if !ok {
+		s = &cameraSelection{key: key, count: len(urls), handlers: make(map[*CCTVLcdHandler]bool)}
+		selections[key] = s
+	}
+	return s
+}
+
+func (s *cameraSelection) join(l *CCTVLcdHandler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers[l] = true
+}
+
+func (s *cameraSelection) leave(l *CCTVLcdHandler) {
+	selectionsLock.Lock()
+	defer selectionsLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.handlers, l)
+	if len(s.handlers) == 0 && selections[s.key] == s {
+		delete(selections, s.key)
+	}
+}
+
+func (s *cameraSelection) current() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.index
+}
+
+// step moves the selection, wrapping around the list, and switches every
+// handler following it.
+func (s *cameraSelection) step(delta int) {
+	s.lock.Lock()
+	s.index = ((s.index+delta)%s.count + s.count) % s.count
+	index := s.index
+	handlers := make([]*CCTVLcdHandler, 0, len(s.handlers))
+	for l := range s.handlers {
+		handlers = append(handlers, l)
+	}
+	s.lock.Unlock()
+	for _, l := range handlers {
+		l.setCamera(index)
+	}
+}
+
+// splitUrls reads one or more URLs separated by new lines or spaces. Commas
+// are left alone, as they can appear in URLs.
+func splitUrls(value any) []string {
+	raw, _ := value.(string)
+	return strings.Fields(raw)
+}
+
+// cameraName is a short name for a camera, its host.
+func cameraName(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Hostname() == "" {
+		return "camera"
+	}
+	return u.Hostname()
+}
+
+// saveSnapshot writes a frame as a JPEG, by default to
+// $XDG_PICTURES_DIR/streamdeckd, or ~/Pictures/streamdeckd.
+func saveSnapshot(frame image.Image, dir string, name string) (string, error) {
+	if dir == "" {
+		dir = os.Getenv("XDG_PICTURES_DIR")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			dir = filepath.Join(home, "Pictures")
+		}
+		dir = filepath.Join(dir, "streamdeckd")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	stamp := time.Now().Format("20060102-150405.000")
+	path := filepath.Join(dir, "cctv-"+name+"-"+strings.ReplaceAll(stamp, ".", "-")+".jpg")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	err = jpeg.Encode(f, frame, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
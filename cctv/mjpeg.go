@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// maxFrameSize caps how much of a stream part is read as one frame, so a
+// stream that never sends a boundary can't exhaust memory.
+const maxFrameSize = 16 << 20
+
+// isStream reports whether a response is an MJPEG stream, and its boundary.
+func isStream(response *http.Response) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		return "", false
+	}
+	// Some cameras include the leading dashes in the parameter
+	boundary := strings.TrimPrefix(params["boundary"], "--")
+	return boundary, boundary != ""
+}
+
+// frameSlot holds the newest frame that hasn't been drawn yet. Putting a frame
+// replaces one that is still waiting, so frames are dropped rather than queued
+// when the deck can't keep up, and are only decoded if they are drawn.
+type frameSlot chan []byte
+
+func newFrameSlot() frameSlot {
+	return make(frameSlot, 1)
+}
+
+func (s frameSlot) put(frame []byte) {
+	for {
+		select {
+		case s <- frame:
+			return
+		default:
+		}
+		select {
+		case <-s:
+		default:
+		}
+	}
+}
+
+// readStream reads the parts of an MJPEG stream over the one connection until
+// it ends, fails or the context is cancelled, drawing the newest frame each
+// time the previous one has been drawn. It reports whether any frame was read.
+func (c *feed) readStream(ctx context.Context, body io.Reader, boundary string, progress func()) (bool, error) {
+	frames := newFrameSlot()
+	done := make(chan struct{})
+	defer close(done)
+	go c.drawFrames(frames, done)
+	reader := multipart.NewReader(body, boundary)
+	read := false
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if ctx.Err() != nil {
+				return read, nil
+			}
+			if errors.Is(err, io.EOF) {
+				return read, errors.New("MJPEG stream ended")
+			}
+			return read, err
+		}
+		frame, err := io.ReadAll(io.LimitReader(part, maxFrameSize))
+		part.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return read, nil
+			}
+			return read, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		read = true
+		progress()
+		frames.put(frame)
+	}
+}
+
+// drawFrames decodes and draws frames from the slot until done is closed.
+func (c *feed) drawFrames(frames frameSlot, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case frame := <-frames:
+			img, _, err := image.Decode(bytes.NewReader(frame))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			c.draw(img)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/number"
+)
+
+// frameOptions is how a camera frame is cropped, turned and scaled to fit a
+// key, and its colours adjusted.
+type frameOptions struct {
+	// Crop is the part of the frame to show as x, y, width and height
+	// fractions of its size, as frames may change size
+	Crop    [4]float64
+	HasCrop bool
+	// Rotate is clockwise, in degrees: 0, 90, 180 or 270
+	Rotate int
+	FlipH  bool
+	FlipV  bool
+	// Fit is "fit" to letterbox the frame, "fill" to crop it to the shape
+	// of the key, or "stretch"
+	Fit       string
+	Grayscale bool
+	// Brightness is added to each channel, from -100 to 100 percent
+	Brightness float64
+}
+
+func frameOptionsFromFields(fields map[string]any) frameOptions {
+	o := frameOptions{Fit: "fit"}
+	if crop, ok := fields["crop"].(string); ok && strings.TrimSpace(crop) != "" {
+		fractions, err := parseCrop(crop)
+		if err != nil {
+			log.Println(err)
+		} else {
+			o.Crop, o.HasCrop = fractions, true
+		}
+	}
+	if rotate, ok := fields["rotate"].(string); ok {
+		degrees, _ := strconv.Atoi(rotate)
+		o.Rotate = ((degrees/90)%4 + 4) % 4 * 90
+	}
+	switch flip, _ := fields["flip"].(string); flip {
+	case "horizontal":
+		o.FlipH = true
+	case "vertical":
+		o.FlipV = true
+	case "both":
+		o.FlipH, o.FlipV = true, true
+	}
+	if fit, ok := fields["fit"].(string); ok && fit != "" {
+		o.Fit = fit
+	}
+	if grayscale, _ := fields["grayscale"].(string); grayscale == "true" {
+		o.Grayscale = true
+	}
+	if brightness, ok := number.Field(fields["brightness"]); ok {
+		o.Brightness = math.Max(-100, math.Min(100, brightness))
+	}
+	return o
+}
+
+// parseCrop reads "x,y,width,height" as percentages of the frame, each with
+// or without a % sign, e.g. "50,0,50,50" for the top right quarter.
+func parseCrop(crop string) ([4]float64, error) {
+	var fractions [4]float64
+	parts := strings.Split(crop, ",")
+	if len(parts) != 4 {
+		return fractions, fmt.Errorf("invalid crop %q, expected x,y,width,height", crop)
+	}
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(part), "%"), 64)
+		if err != nil {
+			return fractions, fmt.Errorf("invalid crop %q: %v", crop, err)
+		}
+		fractions[i] = math.Max(0, math.Min(100, value)) / 100
+	}
+	if fractions[2] <= 0 || fractions[3] <= 0 {
+		return fractions, fmt.Errorf("invalid crop %q, width and height must be more than 0", crop)
+	}
+	return fractions, nil
+}
+
+// process applies the options to a frame, scaling it to width x height. A
+// size of 0 leaves the frame at its own size. The frame is scaled before it is
+// turned, so only the key's pixels are moved.
+func (o frameOptions) process(img image.Image, width int, height int) image.Image {
+	if o.HasCrop {
+		img = crop(img, o.Crop)
+	}
+	if width > 0 && height > 0 {
+		if o.Rotate == 90 || o.Rotate == 270 {
+			img = fit(img, o.Fit, height, width)
+		} else {
+			img = fit(img, o.Fit, width, height)
+		}
+	}
+	if o.Rotate != 0 || o.FlipH || o.FlipV {
+		img = transform(img, o.Rotate, o.FlipH, o.FlipV)
+	}
+	if o.Grayscale || o.Brightness != 0 {
+		img = adjust(img, o.Grayscale, o.Brightness)
+	}
+	return img
+}
+
+func crop(img image.Image, fractions [4]float64) image.Image {
+	b := img.Bounds()
+	r := image.Rect(
+		b.Min.X+int(fractions[0]*float64(b.Dx())),
+		b.Min.Y+int(fractions[1]*float64(b.Dy())),
+		b.Min.X+int((fractions[0]+fractions[2])*float64(b.Dx())),
+		b.Min.Y+int((fractions[1]+fractions[3])*float64(b.Dy())),
+	).Intersect(b)
+	if r.Empty() {
+		return img
+	}
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// transform rotates the frame clockwise, then flips it.
+func transform(img image.Image, rotate int, flipH bool, flipV bool) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if rotate == 90 || rotate == 270 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch rotate {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			if flipH {
+				dx = dw - 1 - dx
+			}
+			if flipV {
+				dy = dh - 1 - dy
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// fit scales the frame into width x height: letterboxed in black, cropped to
+// fill it, or stretched.
+func fit(img image.Image, mode string, width int, height int) image.Image {
+	b := img.Bounds()
+	if mode == "stretch" || b.Dx() == 0 || b.Dy() == 0 {
+		return api.ResizeImageWH(img, width, height)
+	}
+	scaleX := float64(width) / float64(b.Dx())
+	scaleY := float64(height) / float64(b.Dy())
+	scale := math.Min(scaleX, scaleY)
+	if mode == "fill" {
+		scale = math.Max(scaleX, scaleY)
+	}
+	w := max(1, int(math.Round(float64(b.Dx())*scale)))
+	h := max(1, int(math.Round(float64(b.Dy())*scale)))
+	scaled := api.ResizeImageWH(img, w, h)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	offset := image.Pt((width-w)/2, (height-h)/2)
+	draw.Draw(dst, scaled.Bounds().Add(offset), scaled, image.Point{}, draw.Src)
+	return dst
+}
+
+func adjust(img image.Image, grayscale bool, brightness float64) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	shift := brightness / 100 * 255
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			r, g, bl := float64(c.R), float64(c.G), float64(c.B)
+			if grayscale {
+				r = 0.299*r + 0.587*g + 0.114*bl
+				g, bl = r, r
+			}
+			dst.Set(x, y, color.NRGBA{R: clampChannel(r + shift), G: clampChannel(g + shift), B: clampChannel(bl + shift), A: c.A})
+		}
+	}
+	return dst
+}
+
+func clampChannel(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
@@ -5,6 +5,7 @@ go 1.25.1
 require (
 	github.com/Endg4meZer0/go-mpris v1.0.5
 	github.com/godbus/dbus/v5 v5.2.2
+	github.com/gorilla/websocket v1.5.3
 	github.com/the-jonsey/pulseaudio v0.0.2-0.20260222211608-58a869b098fe
 	github.com/unix-streamdeck/api/v2 v2.0.10
 	golang.org/x/sync v0.19.0
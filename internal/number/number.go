@@ -0,0 +1,23 @@
+// Package number reads numeric handler fields, which the daemon's config may
+// hold as a JSON number or as the text typed into a field.
+package number
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Field returns a field's value as a number, reporting false if it isn't set
+// or isn't one.
+func Field(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
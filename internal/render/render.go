@@ -0,0 +1,194 @@
+// Package render holds the image and colour helpers shared by the modules'
+// icon and LCD handlers.
+package render
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/unix-streamdeck/api/v2"
+)
+
+// ErrorColour and SuccessColour outline a key to show how an action went.
+var (
+	ErrorColour   = color.NRGBA{R: 0xe7, G: 0x4c, B: 0x3c, A: 0xff}
+	SuccessColour = color.NRGBA{R: 0x2e, G: 0xcc, B: 0x71, A: 0xff}
+)
+
+// StateOptions are where modules differ in how they draw a state.
+type StateOptions struct {
+	// DefaultLabel is drawn for a state with no background, icon or label
+	DefaultLabel string
+	// TintFrom is the state whose icon is tinted by a "<state>_tint" field,
+	// for a state without an icon of its own, or empty to not tint
+	TintFrom string
+}
+
+// State builds the image for a state, such as "on" or "up", from its
+// "<state>_background" colour, "<state>_icon" image and "<state>_label" text,
+// any of which may be left unset. The label is drawn in "<state>_text_colour",
+// or "text_colour", with the "font_face" and "label_alignment" fields.
+func State(state string, fields map[string]any, width int, height int, options StateOptions) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if background, ok := fields[state+"_background"].(string); ok && background != "" {
+		bg, err := ParseColour(background)
+		if err != nil {
+			log.Println(err)
+		} else {
+			draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		}
+	}
+	if icon := stateIcon(state, fields, width, height, options.TintFrom); icon != nil {
+		draw.Draw(img, img.Bounds(), icon, icon.Bounds().Min, draw.Over)
+	}
+	label, ok := fields[state+"_label"].(string)
+	if !ok || label == "" {
+		if options.DefaultLabel == "" || hasStyle(state, fields) {
+			return img
+		}
+		label = options.DefaultLabel
+	}
+	fontFace, _ := fields["font_face"].(string)
+	textColour, _ := fields[state+"_text_colour"].(string)
+	if textColour == "" {
+		textColour, _ = fields["text_colour"].(string)
+	}
+	alignment, ok := fields["label_alignment"].(string)
+	if !ok || alignment == "" {
+		alignment = string(api.Center)
+	}
+	labelled, err := api.DrawText(img, label, api.DrawTextOptions{
+		VerticalAlignment: api.VerticalAlignment(strings.ToUpper(alignment)),
+		FontFace:          fontFace,
+		Colour:            textColour,
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
+
+func hasStyle(state string, fields map[string]any) bool {
+	for _, name := range []string{"_background", "_icon", "_label", "_tint"} {
+		if value, ok := fields[state+name].(string); ok && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// stateIcon loads the image configured for a state, or tints the icon of
+// another state if the state has a tint but no image of its own.
+func stateIcon(state string, fields map[string]any, width int, height int, tintFrom string) image.Image {
+	if path, ok := fields[state+"_icon"].(string); ok && path != "" {
+		return loadIcon(path, width, height)
+	}
+	tint, ok := fields[state+"_tint"].(string)
+	if !ok || tint == "" || tintFrom == "" || state == tintFrom {
+		return nil
+	}
+	path, ok := fields[tintFrom+"_icon"].(string)
+	if !ok || path == "" {
+		log.Println("image missing: " + tintFrom + "_icon, needed to tint " + state + " state")
+		return nil
+	}
+	icon := loadIcon(path, width, height)
+	if icon == nil {
+		return nil
+	}
+	tintColour, err := ParseColour(tint)
+	if err != nil {
+		log.Println(err)
+		return icon
+	}
+	return Tint(icon, tintColour)
+}
+
+func loadIcon(path string, width int, height int) image.Image {
+	img, err := LoadImage(path)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return api.ResizeImageWH(img, width, height)
+}
+
+func LoadImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// Tint multiplies every pixel by the tint colour, keeping the alpha of the
+// source so transparent areas stay transparent.
+func Tint(img image.Image, tint color.NRGBA) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(uint16(px.R) * uint16(tint.R) / 255),
+				G: uint8(uint16(px.G) * uint16(tint.G) / 255),
+				B: uint8(uint16(px.B) * uint16(tint.B) / 255),
+				A: px.A,
+			})
+		}
+	}
+	return dst
+}
+
+// Outline draws a border of the given width around a copy of the image.
+func Outline(img image.Image, colour color.NRGBA, width int) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	fill := image.NewUniform(colour)
+	draw.Draw(dst, image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+width), fill, image.Point{}, draw.Over)
+	draw.Draw(dst, image.Rect(bounds.Min.X, bounds.Max.Y-width, bounds.Max.X, bounds.Max.Y), fill, image.Point{}, draw.Over)
+	draw.Draw(dst, image.Rect(bounds.Min.X, bounds.Min.Y+width, bounds.Min.X+width, bounds.Max.Y-width), fill, image.Point{}, draw.Over)
+	draw.Draw(dst, image.Rect(bounds.Max.X-width, bounds.Min.Y+width, bounds.Max.X, bounds.Max.Y-width), fill, image.Point{}, draw.Over)
+	return dst
+}
+
+// ParseColour parses the hex colours produced by api.Colour fields: #rgb,
+// #rrggbb or #rrggbbaa, with or without the leading #.
+func ParseColour(hex string) (color.NRGBA, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, errors.New("invalid colour: #" + hex)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, err
+	}
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+// HexColour formats a colour for api.DrawText.
+func HexColour(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
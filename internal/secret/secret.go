@@ -0,0 +1,151 @@
+// Package secret reads the secrets referenced from handler fields, such as an
+// API key or a camera's password.
+package secret
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// A field can hold a reference to the secret rather than the secret itself,
+// so a config synced between machines needn't contain it:
+//   env:NAME                  the NAME environment variable
+//   file:PATH                 the contents of PATH, relative paths are looked
+//                             up in $CREDENTIALS_DIRECTORY for systemd credentials
+//   secret:attr=value,...     the Secret Service item with those attributes
+// Anything else is used as it is.
+
+// secretCacheDuration is how long a secret read from a file or the keyring
+// is reused before it is read again.
+const secretCacheDuration = time.Minute
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+var (
+	secretsLock sync.Mutex
+	secrets     = make(map[string]cachedSecret)
+)
+
+// Resolve returns the secret a field's reference points to, or the field's
+// value if it isn't a reference.
+func Resolve(reference string) (string, error) {
+	kind, rest, ok := strings.Cut(reference, ":")
+	if !ok {
+		return reference, nil
+	}
+	switch kind {
+	case "env":
+		value := os.Getenv(rest)
+		if value == "" {
+			return "", errors.New("environment variable " + rest + " is not set")
+		}
+		return value, nil
+	case "file", "secret":
+		return cachedSecretValue(reference, func() (string, error) {
+			if kind == "file" {
+				return readSecretFile(rest)
+			}
+			return readSecretService(rest)
+		})
+	}
+	return reference, nil
+}
+
+func cachedSecretValue(reference string, read func() (string, error)) (string, error) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	if cached, ok := secrets[reference]; ok && time.Since(cached.fetched) < secretCacheDuration {
+		return cached.value, nil
+	}
+	value, err := read()
+	if err != nil {
+		return "", err
+	}
+	secrets[reference] = cachedSecret{value: value, fetched: time.Now()}
+	return value, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// secretServiceSecret is the Secret struct of the Secret Service API.
+type secretServiceSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// readSecretService looks up a secret in the keyring over the Secret Service
+// D-Bus API, as stored by e.g.
+// secret-tool store --label="Home Assistant" service streamdeckd-lights
+func readSecretService(query string) (string, error) {
+	attributes := make(map[string]string)
+	for _, pair := range strings.Split(query, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", errors.New("invalid secret attributes, expected attr=value: " + pair)
+		}
+		attributes[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return "", err
+	}
+	service := conn.Object("org.freedesktop.secrets", "/org/freedesktop/secrets")
+
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = service.Call("org.freedesktop.Secret.Service.OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Object("org.freedesktop.secrets", session).Call("org.freedesktop.Secret.Session.Close", 0)
+
+	var unlocked, locked []dbus.ObjectPath
+	err = service.Call("org.freedesktop.Secret.Service.SearchItems", 0, attributes).Store(&unlocked, &locked)
+	if err != nil {
+		return "", err
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		var prompt dbus.ObjectPath
+		err = service.Call("org.freedesktop.Secret.Service.Unlock", 0, locked).Store(&unlocked, &prompt)
+		if err != nil {
+			return "", err
+		}
+		if len(unlocked) == 0 {
+			return "", errors.New("keyring is locked, unlock it to read " + query)
+		}
+	}
+	if len(unlocked) == 0 {
+		return "", errors.New("no secret found matching " + query)
+	}
+
+	var found map[dbus.ObjectPath]secretServiceSecret
+	err = service.Call("org.freedesktop.Secret.Service.GetSecrets", 0, unlocked[:1], session).Store(&found)
+	if err != nil {
+		return "", err
+	}
+	secret, ok := found[unlocked[0]]
+	if !ok {
+		return "", errors.New("no secret found matching " + query)
+	}
+	return strings.TrimSpace(string(secret.Value)), nil
+}
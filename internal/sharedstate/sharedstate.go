@@ -0,0 +1,27 @@
+// Package sharedstate guards the shared state the daemon gives the handlers of
+// a key or knob. A module's handlers read and write it from their own
+// goroutines, so their accesses go through one lock. It only covers the
+// handlers of the module using it, not the daemon or other plugins.
+package sharedstate
+
+import "sync"
+
+var lock sync.Mutex
+
+// Get reads a value from a key or knob's shared state.
+func Get(state map[string]any, name string) (any, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	value, ok := state[name]
+	return value, ok
+}
+
+// Set writes a value to a key or knob's shared state, if it has one.
+func Set(state map[string]any, name string, value any) {
+	if state == nil {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	state[name] = value
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// lightBackend is a system the Lights handlers can control and show the state
+// of. Targets and states use Home Assistant's shapes, which other backends
+// translate to and from.
+type lightBackend interface {
+	// action runs what the key handler's fields describe
+	action(fields map[string]any) error
+	toggle(target string) error
+	// turnOn takes Home Assistant light.turn_on data, such as brightness_pct,
+	// color_temp_kelvin or hs_color
+	turnOn(target string, data map[string]any) error
+	getState(target string) (entityState, error)
+	subscribe(target string) *subscription
+}
+
+// backendFromFields picks the backend named by the "backend" field, Home
+// Assistant if unset.
+func backendFromFields(sets ...map[string]any) (lightBackend, error) {
+	backend, _ := field("backend", sets...)
+	switch backend {
+	case "", "home_assistant":
+		return connectionFromFields(sets...)
+	case "hue":
+		return hueBridgeFromFields(sets...)
+	}
+	return nil, errors.New("unknown lights backend: " + backend)
+}
+
+// subscription delivers the latest state of a target. Only the newest state
+// is kept, so a slow reader skips straight to it.
+type subscription struct {
+	C     chan entityState
+	close func()
+}
+
+// Close stops the subscription.
+func (s *subscription) Close() {
+	s.close()
+}
+
+// deliver replaces any state the reader hasn't picked up yet. It never blocks,
+// as the reader may be the one delivering.
+func (s *subscription) deliver(state entityState) {
+	for {
+		select {
+		case s.C <- state:
+			return
+		default:
+		}
+		select {
+		case <-s.C:
+		default:
+		}
+	}
+}
+
+func (c hassConnection) action(fields map[string]any) error {
+	domain, ok := field("domain", fields)
+	if !ok {
+		return errors.New("Missing fields: domain")
+	}
+	// The free text field wins over the picker's selection for the domain
+	service, ok := field("service", fields)
+	if !ok {
+		service, ok = field(domain+"_service", fields)
+	}
+	if !ok {
+		return errors.New("Missing fields: service")
+	}
+	data, err := serviceData(fields)
+	if err != nil {
+		return err
+	}
+	return c.callService(domain, service, data)
+}
+
+func (c hassConnection) toggle(entityId string) error {
+	domain, _, _ := strings.Cut(entityId, ".")
+	return c.callService(domain, "toggle", map[string]any{"entity_id": entityId})
+}
+
+func (c hassConnection) turnOn(entityId string, data map[string]any) error {
+	body := map[string]any{"entity_id": entityId}
+	for key, value := range data {
+		body[key] = value
+	}
+	return c.callService("light", "turn_on", body)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Climate and cover entities have one value the knob adjusts, whatever the
+// mode field says, and their own action for a press or tap.
+
+const (
+	// Temperature sets a climate entity's target temperature
+	Temperature knobMode = "temperature"
+	// Position sets a cover's position
+	Position knobMode = "position"
+)
+
+// entityMode is the mode for the entity's domain.
+func entityMode(entityId string, mode knobMode) knobMode {
+	if mode == Sensor {
+		return mode
+	}
+	switch domain, _, _ := strings.Cut(entityId, "."); domain {
+	case "climate":
+		return Temperature
+	case "cover":
+		return Position
+	}
+	return mode
+}
+
+// domainCall calls a service outside the light domain, which only Home
+// Assistant has.
+func domainCall(backend lightBackend, domain string, service string, data map[string]any) error {
+	conn, ok := backend.(hassConnection)
+	if !ok {
+		return errors.New(domain + " entities need the home_assistant backend")
+	}
+	return conn.callService(domain, service, data)
+}
+
+// press runs the action for a knob press or screen tap: cycling a climate
+// entity's HVAC mode, opening, stopping or closing a cover, or toggling
+// anything else.
+func press(backend lightBackend, entityId string, mode knobMode) error {
+	switch mode {
+	case Temperature:
+		state, err := backend.getState(entityId)
+		if err != nil {
+			return err
+		}
+		hvacMode, ok := nextHvacMode(state)
+		if !ok {
+			return errors.New(entityId + " has no HVAC modes")
+		}
+		return domainCall(backend, "climate", "set_hvac_mode", map[string]any{"entity_id": entityId, "hvac_mode": hvacMode})
+	case Position:
+		state, err := backend.getState(entityId)
+		if err != nil {
+			return err
+		}
+		return domainCall(backend, "cover", coverService(state), map[string]any{"entity_id": entityId})
+	}
+	return backend.toggle(entityId)
+}
+
+// nextHvacMode is the mode after the current one in the entity's list.
+func nextHvacMode(state entityState) (string, bool) {
+	modes, ok := state.Attributes["hvac_modes"].([]any)
+	if !ok || len(modes) == 0 {
+		return "", false
+	}
+	names := make([]string, 0, len(modes))
+	for _, m := range modes {
+		if name, ok := m.(string); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	i := slices.Index(names, state.State)
+	return names[(i+1)%len(names)], true
+}
+
+// coverService stops a moving cover, closes an open one and opens a closed
+// one.
+func coverService(state entityState) string {
+	switch state.State {
+	case "opening", "closing":
+		return "stop_cover"
+	case "open":
+		return "close_cover"
+	}
+	return "open_cover"
+}
+
+// climateText is the current and target temperature, and the HVAC mode.
+func climateText(state entityState) string {
+	var text string
+	if current, ok := state.Attributes["current_temperature"].(float64); ok {
+		text = formatTemperature(current)
+	}
+	if target, ok := state.Attributes["temperature"].(float64); ok {
+		if text != "" {
+			text += " → "
+		}
+		text += formatTemperature(target)
+	}
+	hvacMode := capitalise(strings.ReplaceAll(state.State, "_", " "))
+	if text == "" {
+		return hvacMode
+	}
+	return text + "\n" + hvacMode
+}
+
+func formatTemperature(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64) + "°"
+}
+
+// coverText is the cover's state, with its position if it reports one.
+func coverText(state entityState) string {
+	text := capitalise(state.State)
+	if position, ok := state.Attributes["current_position"].(float64); ok && state.State != "closed" {
+		text += " " + strconv.Itoa(int(position)) + "%"
+	}
+	return text
+}
+
+func capitalise(text string) string {
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// domainColour is the swatch for climate entities, by what they are doing,
+// and covers, by how far open they are.
+func domainColour(state entityState, mode knobMode) (color.NRGBA, bool) {
+	switch mode {
+	case Temperature:
+		action, _ := state.Attributes["hvac_action"].(string)
+		if action == "" {
+			action = state.State
+		}
+		switch action {
+		case "heating", "heat":
+			return color.NRGBA{R: 0xff, G: 0x80, B: 0x20, A: 0xff}, true
+		case "cooling", "cool":
+			return color.NRGBA{R: 0x30, G: 0x90, B: 0xff, A: 0xff}, true
+		case "off":
+			return color.NRGBA{R: 0x30, G: 0x30, B: 0x30, A: 0xff}, true
+		}
+		return color.NRGBA{R: 0x40, G: 0xb0, B: 0x60, A: 0xff}, true
+	case Position:
+		open := 100.0
+		if position, ok := state.Attributes["current_position"].(float64); ok {
+			open = position
+		} else if state.State == "closed" {
+			open = 0
+		}
+		scale := 0.2 + 0.8*open/100
+		return color.NRGBA{R: uint8(0x80 * scale), G: uint8(0xc0 * scale), B: uint8(0xff * scale), A: 0xff}, true
+	}
+	return color.NRGBA{}, false
+}
+
+// roundToStep keeps the target temperature on the entity's step, so repeated
+// turns don't drift by floating point error.
+func roundToStep(value float64, step float64) float64 {
+	if step <= 0 {
+		return value
+	}
+	return math.Round(value/step) / (1 / step)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/render"
+	"streamdeckd-modules/internal/sharedstate"
+)
+
+// Feedback for a service call is shown on the key through its shared state,
+// so any icon handler that understands it can draw it, not just the Lights
+// one. SharedState["feedback"] holds a map with:
+//   kind   "error" or "success"
+//   text   a short label, such as the HTTP status
+//   until  the time.Time to show it until
+
+const feedbackDuration = 2 * time.Second
+
+func showFeedback(key api.KeyConfigV3, kind string, text string) {
+	feedback := map[string]any{
+		"kind":  kind,
+		"text":  text,
+		"until": time.Now().Add(feedbackDuration),
+	}
+	sharedstate.Set(key.SharedState, "feedback", feedback)
+	if handler, ok := key.IconHandlerStruct.(*LightsIconHandler); ok && key.IconHandler == "Lights" {
+		handler.ShowFeedback(feedback)
+	}
+}
+
+// errorText is the label shown for a failed call: the HTTP status if Home
+// Assistant answered, "Link" while a Hue bridge is waiting for its link button
+// to be pressed, otherwise why it couldn't be reached.
+func errorText(err error) string {
+	var status *statusError
+	if errors.As(err, &status) {
+		return strconv.Itoa(status.StatusCode)
+	}
+	var hueErr *hueError
+	if errors.As(err, &hueErr) && hueErr.Type == hueLinkButtonNotPressed {
+		return "Link"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "Timeout"
+	}
+	return "Error"
+}
+
+// ShowFeedback draws the feedback over the current icon until it expires.
+// State changes in the meantime are drawn once it has.
+func (c *LightsIconHandler) ShowFeedback(feedback map[string]any) {
+	until, _ := feedback["until"].(time.Time)
+	kind, _ := feedback["kind"].(string)
+	text, _ := feedback["text"].(string)
+	c.drawLock.Lock()
+	defer c.drawLock.Unlock()
+	if c.Callback == nil || !c.Running || c.current == nil {
+		return
+	}
+	c.feedbackUntil = until
+	c.Callback(feedbackImage(c.current, kind, text))
+	time.AfterFunc(time.Until(until), func() {
+		c.drawLock.Lock()
+		defer c.drawLock.Unlock()
+		if !c.Running || time.Now().Before(c.feedbackUntil) {
+			return
+		}
+		c.Callback(c.current)
+	})
+}
+
+// feedbackImage dims the icon, outlines it in red or green and draws the
+// label over it.
+func feedbackImage(base image.Image, kind string, text string) image.Image {
+	bounds := base.Bounds()
+	dimmed := image.NewRGBA(bounds)
+	draw.Draw(dimmed, bounds, base, bounds.Min, draw.Src)
+	draw.Draw(dimmed, bounds, image.NewUniform(color.NRGBA{A: 0xa0}), image.Point{}, draw.Over)
+	colour := render.ErrorColour
+	if kind == "success" {
+		colour = render.SuccessColour
+		if text == "" {
+			text = "OK"
+		}
+	}
+	img := render.Outline(dimmed, colour, max(min(bounds.Dx(), bounds.Dy())/12, 2))
+	if text == "" {
+		return img
+	}
+	labelled, err := api.DrawText(img, text, api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          "bold",
+		Colour:            render.HexColour(colour),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"streamdeckd-modules/internal/secret"
+)
+
+// hassConnection holds the settings needed to talk to a Home Assistant
+// instance's REST API.
+type hassConnection struct {
+	// BaseUrl includes the scheme, with no trailing slash
+	BaseUrl   string
+	ApiKey    string
+	Transport transportOptions
+}
+
+type entityState struct {
+	EntityId    string         `json:"entity_id"`
+	State       string         `json:"state"`
+	Attributes  map[string]any `json:"attributes"`
+	LastChanged time.Time      `json:"last_changed"`
+}
+
+// connectionFromFields reads the connection settings from the first of the
+// field sets that has them, so handler fields override the shared fields
+// linked between the key and icon handlers.
+func connectionFromFields(sets ...map[string]any) (hassConnection, error) {
+	baseUrl, ok := field("base_url", sets...)
+	if !ok {
+		return hassConnection{}, errors.New("Missing fields: base_url")
+	}
+	apiKey, ok := field("api_key", sets...)
+	if !ok {
+		return hassConnection{}, errors.New("Missing fields: api_key")
+	}
+	apiKey, err := secret.Resolve(apiKey)
+	if err != nil {
+		return hassConnection{}, err
+	}
+	return hassConnection{BaseUrl: normaliseBaseUrl(baseUrl), ApiKey: apiKey, Transport: transportFromFields(sets...)}, nil
+}
+
+// normaliseBaseUrl accepts a full URL, or a bare host and port, which was all
+// older configs could hold, and is treated as plain HTTP.
+func normaliseBaseUrl(baseUrl string) string {
+	if !strings.Contains(baseUrl, "://") {
+		baseUrl = "http://" + baseUrl
+	}
+	return strings.TrimRight(baseUrl, "/")
+}
+
+func field(name string, sets ...map[string]any) (string, bool) {
+	for _, set := range sets {
+		value, ok := set[name].(string)
+		if ok && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (c hassConnection) url(path string) string {
+	return c.BaseUrl + path
+}
+
+func (c hassConnection) websocketUrl() string {
+	if rest, ok := strings.CutPrefix(c.BaseUrl, "https://"); ok {
+		return "wss://" + rest + "/api/websocket"
+	}
+	return "ws://" + strings.TrimPrefix(c.BaseUrl, "http://") + "/api/websocket"
+}
+
+func (c hassConnection) request(method string, path string, body any) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+	req, err := http.NewRequest(method, c.url(path), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.ApiKey)
+	client, err := c.Transport.client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &statusError{Method: method, Path: path, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func (c hassConnection) callService(domain string, service string, data map[string]any) error {
+	resp, err := c.request("POST", "/api/services/"+domain+"/"+service, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c hassConnection) getJSON(path string, v any) error {
+	resp, err := c.request("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c hassConnection) getState(entityId string) (entityState, error) {
+	var state entityState
+	err := c.getJSON("/api/states/"+entityId, &state)
+	return state, err
+}
+
+// statusError is returned for responses outside the 2xx range, so callers can
+// tell an auth failure from an unreachable server.
+type statusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
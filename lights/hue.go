@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"streamdeckd-modules/internal/number"
+	"streamdeckd-modules/internal/secret"
+)
+
+const huePollInterval = time.Second
+
+// hueLinkButtonNotPressed is the error type the bridge answers a pairing
+// request with until its link button has been pressed.
+const hueLinkButtonNotPressed = 101
+
+// hueBridge talks to a Philips Hue bridge's local REST API. Targets are the
+// resource paths the API uses: lights/<id>, groups/<id> or scenes/<id>.
+type hueBridge struct {
+	// BaseUrl includes the scheme, with no trailing slash
+	BaseUrl string
+	// AppKey is the key from the app key field, if set. Otherwise the key
+	// stored when the bridge was paired is used.
+	AppKey    string
+	Transport transportOptions
+}
+
+// hueState is the part of a light's state, or a group's action, the handlers
+// use.
+type hueState struct {
+	On  bool     `json:"on"`
+	Bri *float64 `json:"bri,omitempty"`
+	Hue *float64 `json:"hue,omitempty"`
+	Sat *float64 `json:"sat,omitempty"`
+	Ct  *float64 `json:"ct,omitempty"`
+}
+
+// hueResource is a light, group or scene. A group's state only says whether
+// any or all of its lights are on; its last action holds the rest.
+type hueResource struct {
+	Name  string `json:"name"`
+	State struct {
+		hueState
+		AnyOn bool `json:"any_on"`
+	} `json:"state"`
+	Action hueState `json:"action"`
+	// Group is the group a scene belongs to
+	Group string `json:"group"`
+}
+
+// hueError is an error the bridge reports in the body of a 200 response.
+type hueError struct {
+	Type        int    `json:"type"`
+	Address     string `json:"address"`
+	Description string `json:"description"`
+}
+
+func (e *hueError) Error() string {
+	if e.Address == "" {
+		return "hue: " + e.Description
+	}
+	return fmt.Sprintf("hue %s: %s", e.Address, e.Description)
+}
+
+func hueBridgeFromFields(sets ...map[string]any) (hueBridge, error) {
+	address, ok := field("bridge_address", sets...)
+	if !ok {
+		return hueBridge{}, errors.New("Missing fields: bridge_address")
+	}
+	bridge := hueBridge{BaseUrl: normaliseBaseUrl(address), Transport: transportFromFields(sets...)}
+	if appKey, ok := field("app_key", sets...); ok {
+		appKey, err := secret.Resolve(appKey)
+		if err != nil {
+			return hueBridge{}, err
+		}
+		bridge.AppKey = appKey
+	}
+	return bridge, nil
+}
+
+// hueKeyFile is where the app key from pairing with a bridge is kept, so it
+// survives a daemon restart.
+func hueKeyFile(baseUrl string) (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	name := strings.NewReplacer("://", "_", "/", "_", ":", "_").Replace(baseUrl)
+	return filepath.Join(dir, "streamdeckd", "lights", "hue", name), nil
+}
+
+var hueKeysLock sync.Mutex
+
+// appKey returns the bridge's app key, pairing with the bridge if there isn't
+// one yet. Pairing fails with a hueError until the link button is pressed, so
+// it is retried on every call until then.
+func (b hueBridge) appKey() (string, error) {
+	if b.AppKey != "" {
+		return b.AppKey, nil
+	}
+	hueKeysLock.Lock()
+	defer hueKeysLock.Unlock()
+	path, err := hueKeyFile(b.BaseUrl)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	var result []struct {
+		Success *struct {
+			Username string `json:"username"`
+		} `json:"success"`
+	}
+	err = b.do("POST", "/api", map[string]any{"devicetype": "streamdeckd#lights"}, &result)
+	if err != nil {
+		return "", err
+	}
+	if len(result) == 0 || result[0].Success == nil {
+		return "", errors.New("hue: no app key in pairing response")
+	}
+	appKey := result[0].Success.Username
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(path, []byte(appKey+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	log.Println("Paired with Hue bridge", b.BaseUrl)
+	return appKey, nil
+}
+
+// do sends a request to the bridge, and decodes the response into v. Errors
+// in the body are returned as a hueError.
+func (b hueBridge) do(method string, path string, body any, v any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+	req, err := http.NewRequest(method, b.BaseUrl+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client, err := b.Transport.client()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{Method: method, Path: path, StatusCode: resp.StatusCode}
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var errs []struct {
+		Error *hueError `json:"error"`
+	}
+	if json.Unmarshal(data, &errs) == nil {
+		for _, e := range errs {
+			if e.Error != nil {
+				return e.Error
+			}
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// resource sends a request for a resource under the bridge's app key.
+func (b hueBridge) resource(method string, path string, body any, v any) error {
+	appKey, err := b.appKey()
+	if err != nil {
+		return err
+	}
+	return b.do(method, "/api/"+appKey+"/"+path, body, v)
+}
+
+// splitTarget checks a target is a light, group or scene, and returns its
+// kind and ID.
+func splitTarget(target string) (string, string, error) {
+	kind, id, ok := strings.Cut(strings.Trim(target, "/"), "/")
+	if ok && id != "" {
+		switch kind {
+		case "lights", "groups", "scenes":
+			return kind, id, nil
+		}
+	}
+	return "", "", errors.New("hue: target must be lights/<id>, groups/<id> or scenes/<id>: " + target)
+}
+
+// statePath is where changes to a light or group's state are sent.
+func statePath(kind string, id string) string {
+	if kind == "groups" {
+		return "groups/" + id + "/action"
+	}
+	return "lights/" + id + "/state"
+}
+
+func (b hueBridge) getResource(kind string, id string) (hueResource, error) {
+	var resource hueResource
+	err := b.resource("GET", kind+"/"+id, nil, &resource)
+	return resource, err
+}
+
+// getState reads a light, group or scene, and translates it into the shape of
+// a Home Assistant light. A scene shows the state of its group.
+func (b hueBridge) getState(target string) (entityState, error) {
+	kind, id, err := splitTarget(target)
+	if err != nil {
+		return entityState{}, err
+	}
+	resource, err := b.getResource(kind, id)
+	if err != nil {
+		return entityState{}, err
+	}
+	name := resource.Name
+	if kind == "scenes" {
+		if resource.Group == "" {
+			return entityState{}, errors.New("hue: scene " + id + " has no group")
+		}
+		kind = "groups"
+		resource, err = b.getResource(kind, resource.Group)
+		if err != nil {
+			return entityState{}, err
+		}
+	}
+	state := resource.State.hueState
+	if kind == "groups" {
+		state = resource.Action
+		state.On = resource.State.AnyOn
+	}
+	return hueEntityState(target, name, state), nil
+}
+
+func hueEntityState(target string, name string, state hueState) entityState {
+	attributes := map[string]any{
+		"friendly_name":         name,
+		"min_color_temp_kelvin": 2000.0,
+		"max_color_temp_kelvin": 6500.0,
+	}
+	if state.Bri != nil {
+		attributes["brightness"] = math.Round(*state.Bri / 254 * 255)
+	}
+	if state.Ct != nil && *state.Ct > 0 {
+		attributes["color_temp_kelvin"] = math.Round(1e6 / *state.Ct)
+	}
+	if state.Hue != nil && state.Sat != nil {
+		hue := *state.Hue / 65535 * 360
+		saturation := *state.Sat / 254 * 100
+		attributes["hs_color"] = []any{hue, saturation}
+		r, g, bl := hsToRgb(hue, saturation)
+		attributes["rgb_color"] = []any{r, g, bl}
+	}
+	status := "off"
+	if state.On {
+		status = "on"
+	}
+	return entityState{EntityId: target, State: status, Attributes: attributes}
+}
+
+// hsToRgb converts a hue in degrees and saturation in percent to the RGB
+// colour at full value, for the LCD swatch.
+func hsToRgb(hue float64, saturation float64) (float64, float64, float64) {
+	s := saturation / 100
+	h := math.Mod(hue, 360) / 60
+	x := s * (1 - math.Abs(math.Mod(h, 2)-1))
+	var r, g, b float64
+	switch int(h) {
+	case 0:
+		r, g, b = s, x, 0
+	case 1:
+		r, g, b = x, s, 0
+	case 2:
+		r, g, b = 0, s, x
+	case 3:
+		r, g, b = 0, x, s
+	case 4:
+		r, g, b = x, 0, s
+	default:
+		r, g, b = s, 0, x
+	}
+	m := 1 - s
+	return math.Round((r + m) * 255), math.Round((g + m) * 255), math.Round((b + m) * 255)
+}
+
+// hueBody translates Home Assistant light.turn_on data into a Hue state
+// change. Data the bridge has no equivalent for is ignored.
+func hueBody(data map[string]any) map[string]any {
+	body := map[string]any{"on": true}
+	if pct, ok := number.Field(data["brightness_pct"]); ok {
+		if pct <= 0 {
+			return map[string]any{"on": false}
+		}
+		body["bri"] = int(math.Max(1, math.Round(pct/100*254)))
+	}
+	if brightness, ok := number.Field(data["brightness"]); ok {
+		if brightness <= 0 {
+			return map[string]any{"on": false}
+		}
+		body["bri"] = int(math.Max(1, math.Round(brightness/255*254)))
+	}
+	if kelvin, ok := number.Field(data["color_temp_kelvin"]); ok && kelvin > 0 {
+		body["ct"] = int(math.Max(153, math.Min(500, math.Round(1e6/kelvin))))
+	}
+	if hs, ok := data["hs_color"].([]float64); ok && len(hs) == 2 {
+		body["hue"] = int(math.Round(math.Mod(hs[0], 360) / 360 * 65535))
+		body["sat"] = int(math.Round(hs[1] / 100 * 254))
+	} else if hs, ok := data["hs_color"].([]any); ok && len(hs) == 2 {
+		hue, _ := number.Field(hs[0])
+		saturation, _ := number.Field(hs[1])
+		body["hue"] = int(math.Round(math.Mod(hue, 360) / 360 * 65535))
+		body["sat"] = int(math.Round(saturation / 100 * 254))
+	}
+	if transition, ok := number.Field(data["transition"]); ok {
+		body["transitiontime"] = int(math.Round(transition * 10))
+	}
+	return body
+}
+
+func (b hueBridge) setState(kind string, id string, body map[string]any) error {
+	if kind == "scenes" {
+		scene, err := b.getResource(kind, id)
+		if err != nil {
+			return err
+		}
+		if on, _ := body["on"].(bool); on {
+			body["scene"] = id
+		}
+		kind, id = "groups", scene.Group
+	}
+	return b.resource("PUT", statePath(kind, id), body, nil)
+}
+
+// action runs the key handler's service on its target. Only toggle, turn_on
+// and turn_off mean anything to the bridge; toggle is the default.
+func (b hueBridge) action(fields map[string]any) error {
+	target, ok := firstEntityId(fields)
+	if !ok {
+		return errors.New("Missing fields: entity_id")
+	}
+	service, _ := field("service", fields)
+	switch service {
+	case "", "toggle":
+		return b.toggle(target)
+	case "turn_on":
+		data, err := serviceData(fields)
+		if err != nil {
+			return err
+		}
+		return b.turnOn(target, data)
+	case "turn_off":
+		kind, id, err := splitTarget(target)
+		if err != nil {
+			return err
+		}
+		return b.setState(kind, id, map[string]any{"on": false})
+	}
+	return errors.New("hue: unsupported service: " + service)
+}
+
+// toggle turns a light or group off if it's on, and on otherwise. Toggling a
+// scene turns its group off, or recalls the scene.
+func (b hueBridge) toggle(target string) error {
+	kind, id, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+	state, err := b.getState(target)
+	if err != nil {
+		return err
+	}
+	return b.setState(kind, id, map[string]any{"on": !isOn(state)})
+}
+
+func (b hueBridge) turnOn(target string, data map[string]any) error {
+	kind, id, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+	return b.setState(kind, id, hueBody(data))
+}
+
+// subscribe polls the target, as the bridge's v1 API has no events. Only
+// changes are delivered.
+func (b hueBridge) subscribe(target string) *subscription {
+	quit := make(chan bool)
+	sub := &subscription{C: make(chan entityState, 1)}
+	var once sync.Once
+	sub.close = func() { once.Do(func() { close(quit) }) }
+	go func() {
+		ticker := time.NewTicker(huePollInterval)
+		defer ticker.Stop()
+		var last entityState
+		var lastErr string
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			state, err := b.getState(target)
+			if err != nil {
+				// Logged once, rather than every second until the link
+				// button is pressed or the bridge is back
+				if err.Error() != lastErr {
+					log.Println(err)
+					lastErr = err.Error()
+				}
+				continue
+			}
+			lastErr = ""
+			if state.State != last.State || fmt.Sprint(state.Attributes) != fmt.Sprint(last.Attributes) {
+				last = state
+				sub.deliver(state)
+			}
+		}
+	}()
+	return sub
+}
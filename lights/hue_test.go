@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubBridge is a Hue bridge's v1 API, serving fixed resources under one app
+// key, and recording the state changes it is sent.
+type stubBridge struct {
+	t       *testing.T
+	appKey  string
+	server  *httptest.Server
+	lock    sync.Mutex
+	linked  bool
+	pairs   int
+	puts    map[string]map[string]any
+	objects map[string]any
+}
+
+func newStubBridge(t *testing.T) *stubBridge {
+	b := &stubBridge{
+		t:      t,
+		appKey: "stub-app-key",
+		puts:   make(map[string]map[string]any),
+		objects: map[string]any{
+			"lights/1": map[string]any{"name": "Desk", "state": map[string]any{"on": true, "bri": 254, "ct": 250}},
+			"groups/2": map[string]any{
+				"name":   "Living Room",
+				"state":  map[string]any{"any_on": true, "all_on": false},
+				"action": map[string]any{"on": false, "bri": 127, "hue": 21845, "sat": 254},
+			},
+			"scenes/abc": map[string]any{"name": "Relax", "group": "2"},
+		},
+	}
+	b.server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.server.Close)
+	return b
+}
+
+func (b *stubBridge) bridge() hueBridge {
+	return hueBridge{BaseUrl: b.server.URL, AppKey: b.appKey}
+}
+
+func (b *stubBridge) serve(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// The bridge reports errors in the body, with a 200 status
+	hueErr := func(kind int, address string, description string) {
+		json.NewEncoder(w).Encode([]any{map[string]any{"error": map[string]any{"type": kind, "address": address, "description": description}}})
+	}
+	if r.URL.Path == "/api" && r.Method == "POST" {
+		b.pairs++
+		if !b.linked {
+			hueErr(hueLinkButtonNotPressed, "", "link button not pressed")
+			return
+		}
+		json.NewEncoder(w).Encode([]any{map[string]any{"success": map[string]any{"username": b.appKey}}})
+		return
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, "/api/"+b.appKey+"/")
+	if !ok {
+		hueErr(1, r.URL.Path, "unauthorized user")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		object, ok := b.objects[path]
+		if !ok {
+			hueErr(3, "/"+path, "resource, /"+path+", not available")
+			return
+		}
+		json.NewEncoder(w).Encode(object)
+	case "PUT":
+		var body map[string]any
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			b.t.Error(err)
+		}
+		b.puts[path] = body
+		json.NewEncoder(w).Encode([]any{map[string]any{"success": map[string]any{"/" + path + "/on": body["on"]}}})
+	}
+}
+
+func (b *stubBridge) put(path string) map[string]any {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.puts[path]
+}
+
+func TestHuePairing(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	stub := newStubBridge(t)
+	bridge := stub.bridge()
+	bridge.AppKey = ""
+
+	_, err := bridge.getState("lights/1")
+	var hueErr *hueError
+	if !errors.As(err, &hueErr) || hueErr.Type != hueLinkButtonNotPressed {
+		t.Fatalf("expected link button error, got %v", err)
+	}
+	if errorText(err) != "Link" {
+		t.Fatalf("link button error shown as %q", errorText(err))
+	}
+
+	stub.lock.Lock()
+	stub.linked = true
+	stub.lock.Unlock()
+	state, err := bridge.getState("lights/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != "on" {
+		t.Fatalf("light state %q", state.State)
+	}
+	path, err := hueKeyFile(bridge.BaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(data)) != stub.appKey {
+		t.Fatalf("stored app key %q", data)
+	}
+
+	// The stored key is used from then on, without pairing again
+	if _, err := bridge.getState("lights/1"); err != nil {
+		t.Fatal(err)
+	}
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	if stub.pairs != 2 {
+		t.Fatalf("paired %d times", stub.pairs)
+	}
+}
+
+func TestHueErrorInBody(t *testing.T) {
+	stub := newStubBridge(t)
+	_, err := stub.bridge().getState("lights/9")
+	var hueErr *hueError
+	if !errors.As(err, &hueErr) {
+		t.Fatalf("expected a hueError, got %v", err)
+	}
+	if hueErr.Type != 3 || hueErr.Address != "/lights/9" {
+		t.Fatalf("unexpected error %+v", hueErr)
+	}
+
+	bridge := stub.bridge()
+	bridge.AppKey = "wrong"
+	if _, err := bridge.getState("lights/1"); !errors.As(err, &hueErr) || hueErr.Type != 1 {
+		t.Fatalf("expected unauthorized user, got %v", err)
+	}
+}
+
+func TestHueSceneFollowsGroup(t *testing.T) {
+	stub := newStubBridge(t)
+	bridge := stub.bridge()
+	state, err := bridge.getState("scenes/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A group is on if any of its lights are, and its action has the rest
+	if state.EntityId != "scenes/abc" || state.State != "on" {
+		t.Fatalf("scene state %+v", state)
+	}
+	if name := state.Attributes["friendly_name"]; name != "Relax" {
+		t.Fatalf("scene name %v", name)
+	}
+	if brightness := state.Attributes["brightness"]; brightness != 128.0 {
+		t.Fatalf("scene brightness %v", brightness)
+	}
+
+	if err := bridge.turnOn("scenes/abc", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if body := stub.put("groups/2/action"); body["scene"] != "abc" || body["on"] != true {
+		t.Fatalf("scene recalled with %v", body)
+	}
+	// Toggling a scene whose group is on turns the group off
+	if err := bridge.toggle("scenes/abc"); err != nil {
+		t.Fatal(err)
+	}
+	if body := stub.put("groups/2/action"); body["on"] != false || body["scene"] != nil {
+		t.Fatalf("scene toggled with %v", body)
+	}
+}
+
+func TestHueBody(t *testing.T) {
+	tests := []struct {
+		data map[string]any
+		body map[string]any
+	}{
+		{map[string]any{}, map[string]any{"on": true}},
+		{map[string]any{"brightness_pct": 50}, map[string]any{"on": true, "bri": 127}},
+		{map[string]any{"brightness_pct": "0"}, map[string]any{"on": false}},
+		{map[string]any{"brightness_pct": 0.1}, map[string]any{"on": true, "bri": 1}},
+		{map[string]any{"brightness": 255.0}, map[string]any{"on": true, "bri": 254}},
+		{map[string]any{"brightness": 0}, map[string]any{"on": false}},
+		{map[string]any{"color_temp_kelvin": 4000}, map[string]any{"on": true, "ct": 250}},
+		{map[string]any{"color_temp_kelvin": 10000}, map[string]any{"on": true, "ct": 153}},
+		{map[string]any{"color_temp_kelvin": 1000}, map[string]any{"on": true, "ct": 500}},
+		{map[string]any{"hs_color": []float64{120, 100}}, map[string]any{"on": true, "hue": 21845, "sat": 254}},
+		{map[string]any{"hs_color": []any{360.0, 50.0}}, map[string]any{"on": true, "hue": 0, "sat": 127}},
+		{map[string]any{"transition": 1.5}, map[string]any{"on": true, "transitiontime": 15}},
+		{map[string]any{"effect": "colorloop"}, map[string]any{"on": true}},
+	}
+	for _, test := range tests {
+		if body := hueBody(test.data); !reflect.DeepEqual(body, test.body) {
+			t.Errorf("hueBody(%v) = %v, want %v", test.data, body, test.body)
+		}
+	}
+}
+
+func TestHueEntityState(t *testing.T) {
+	bri, hue, sat, ct := 254.0, 21845.0, 254.0, 250.0
+	state := hueEntityState("lights/1", "Desk", hueState{On: true, Bri: &bri, Hue: &hue, Sat: &sat, Ct: &ct})
+	want := map[string]any{
+		"friendly_name":         "Desk",
+		"min_color_temp_kelvin": 2000.0,
+		"max_color_temp_kelvin": 6500.0,
+		"brightness":            255.0,
+		"color_temp_kelvin":     4000.0,
+		"hs_color":              []any{120.0, 100.0},
+		"rgb_color":             []any{0.0, 255.0, 0.0},
+	}
+	if state.State != "on" || !reflect.DeepEqual(state.Attributes, want) {
+		t.Fatalf("hueEntityState = %+v", state)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"golang.org/x/sync/semaphore"
+	"streamdeckd-modules/internal/render"
+	"streamdeckd-modules/internal/sharedstate"
+)
+
+// LightsIconHandler shows whether a Home Assistant entity is on or off, with
+// an optional attribute such as the brightness drawn over it, or, as a
+// sensor, its value and history. It can also show the health of the
+// connection to Home Assistant.
+type LightsIconHandler struct {
+	Running   bool
+	Lock      *semaphore.Weighted
+	Callback  func(image image.Image)
+	Quit      chan bool
+	OnBuff    image.Image
+	OffBuff   image.Image
+	FirstLoop bool
+
+	// drawLock guards the icon last drawn for the state, and how long
+	// feedback is drawn over it for
+	drawLock      sync.Mutex
+	current       image.Image
+	feedbackUntil time.Time
+	// refresh asks a status icon to check again
+	refresh chan struct{}
+}
+
+func (c *LightsIconHandler) Start(k api.KeyConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
+	if c.Lock == nil {
+		c.Lock = semaphore.NewWeighted(1)
+	}
+	// A fresh, buffered channel per run, so Stop never blocks on a loop that
+	// didn't start or has already exited
+	c.Quit = make(chan bool, 1)
+	c.Callback = callback
+	// Only a status icon takes presses, and a reused handler may have been one
+	c.refresh = nil
+	if c.OnBuff == nil {
+		c.OnBuff = renderState("on", k.IconHandlerFields, info.IconSize, info.IconSize)
+	}
+	if c.OffBuff == nil {
+		c.OffBuff = renderState("off", k.IconHandlerFields, info.IconSize, info.IconSize)
+	}
+	if display, _ := k.IconHandlerFields["display"].(string); display == "status" {
+		c.startStatus(k, info)
+		return
+	}
+	entityId, ok := firstEntityId(k.IconHandlerFields, k.KeyHandlerFields)
+	if !ok {
+		log.Println("Missing fields: entity_id")
+		return
+	}
+	backend, err := backendFromFields(k.IconHandlerFields, k.SharedHandlerFields, k.KeyHandlerFields)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.FirstLoop = true
+	c.Running = true
+	go c.loop(k, backend, entityId, c.Quit)
+}
+
+func (c *LightsIconHandler) loop(k api.KeyConfigV3, backend lightBackend, entityId string, quit chan bool) {
+	ctx := context.Background()
+	err := c.Lock.Acquire(ctx, 1)
+	if err != nil {
+		return
+	}
+	defer c.Lock.Release(1)
+	sub := backend.subscribe(entityId)
+	defer sub.Close()
+	// The subscription only reports changes, so fetch the current state once
+	if state, err := backend.getState(entityId); err != nil {
+		log.Println(err)
+	} else {
+		sub.deliver(state)
+	}
+	var sensor *sensorDisplay
+	var redraw <-chan time.Time
+	if display, _ := k.IconHandlerFields["display"].(string); display == "sensor" {
+		sensor = sensorFromFields(k.IconHandlerFields)
+		sensor.loadHistory(backend, entityId)
+		ticker := time.NewTicker(sensorRedrawInterval)
+		defer ticker.Stop()
+		redraw = ticker.C
+	}
+	var last string
+	var current entityState
+	for {
+		select {
+		case <-quit:
+			return
+		case <-redraw:
+			if current.EntityId != "" {
+				c.draw(c.sensorImage(sensor, current, k.IconHandlerFields))
+			}
+		case state := <-sub.C:
+			if sensor != nil {
+				current = state
+				sensor.record(state)
+				c.FirstLoop = false
+				sharedstate.Set(k.SharedState, "state", state.State)
+				c.draw(c.sensorImage(sensor, state, k.IconHandlerFields))
+				continue
+			}
+			attribute, _ := k.IconHandlerFields["attribute"].(string)
+			text := attributeText(state, attribute)
+			if state.State+text == last && !c.FirstLoop {
+				continue
+			}
+			last = state.State + text
+			c.FirstLoop = false
+			sharedstate.Set(k.SharedState, "state", state.State)
+			c.draw(c.stateImage(state, text, k.IconHandlerFields))
+		}
+	}
+}
+
+// draw shows the icon for the state, unless feedback is being shown, in
+// which case it's drawn once the feedback expires.
+func (c *LightsIconHandler) draw(img image.Image) {
+	c.drawLock.Lock()
+	defer c.drawLock.Unlock()
+	c.current = img
+	if time.Now().Before(c.feedbackUntil) {
+		return
+	}
+	c.Callback(img)
+}
+
+func (c *LightsIconHandler) stateImage(state entityState, text string, fields map[string]any) image.Image {
+	img := c.OffBuff
+	if isOn(state) {
+		img = c.OnBuff
+	}
+	if text == "" {
+		return img
+	}
+	fontFace, _ := fields["font_face"].(string)
+	textColour, _ := fields["text_colour"].(string)
+	imgParsed, err := api.DrawText(img, text, api.DrawTextOptions{
+		VerticalAlignment: api.Bottom,
+		FontFace:          fontFace,
+		Colour:            textColour,
+		FontSize:          int64(img.Bounds().Dy() / 4),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return imgParsed
+}
+
+func (c *LightsIconHandler) sensorImage(sensor *sensorDisplay, state entityState, fields map[string]any) image.Image {
+	size := c.OffBuff.Bounds()
+	return sensor.image(state, fields, size.Dx(), size.Dy())
+}
+
+func (c *LightsIconHandler) IsRunning() bool {
+	return c.Running
+}
+
+func (c *LightsIconHandler) SetRunning(running bool) {
+	c.Running = running
+}
+
+func (c *LightsIconHandler) Stop() {
+	c.Running = false
+	select {
+	case c.Quit <- true:
+	default:
+	}
+}
+
+func isOn(state entityState) bool {
+	switch state.State {
+	case "on", "open", "home", "playing", "unlocked":
+		return true
+	}
+	return false
+}
+
+// attributeText formats an attribute for display. Brightness is reported by
+// Home Assistant as 0-255, so it's shown as a percentage.
+func attributeText(state entityState, attribute string) string {
+	if attribute == "" {
+		return ""
+	}
+	value, ok := state.Attributes[attribute]
+	if !ok || value == nil {
+		return ""
+	}
+	switch v := value.(type) {
+	case float64:
+		if attribute == "brightness" {
+			return strconv.Itoa(int(math.Round(v/255*100))) + "%"
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// renderState builds the image for a state ("on" or "off") from its
+// background colour, image and label, any of which may be left unset. A state
+// with none of them shows its name.
+func renderState(state string, fields map[string]any, width int, height int) image.Image {
+	return render.State(state, fields, width, height, render.StateOptions{DefaultLabel: strings.ToUpper(state)})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"golang.org/x/sync/semaphore"
+	"streamdeckd-modules/internal/number"
+	"streamdeckd-modules/internal/sharedstate"
+)
+
+// knobMode is what turning the knob adjusts on a light.
+type knobMode string
+
+const (
+	Brightness knobMode = "brightness"
+	ColourTemp knobMode = "color_temp"
+	Hue        knobMode = "hue"
+	// Sensor only shows the entity's value, and the knob does nothing
+	Sensor knobMode = "sensor"
+)
+
+var knobModes = map[string]knobMode{
+	"brightness": Brightness,
+	"color_temp": ColourTemp,
+	"hue":        Hue,
+	"sensor":     Sensor,
+}
+
+// serviceCallInterval is the fastest knob turns are sent to Home Assistant,
+// anything in between is coalesced into the next call.
+const serviceCallInterval = 250 * time.Millisecond
+
+// knobValueTimeout is how long the knob keeps adjusting its own target before
+// it reads the entity's state again.
+const knobValueTimeout = 2 * time.Second
+
+type LightsLcdHandler struct {
+	Running   bool
+	Lock      *semaphore.Weighted
+	Callback  func(image image.Image)
+	Quit      chan bool
+	FirstLoop bool
+
+	// stateLock guards the latest state from the subscription, which the knob
+	// starts turning from
+	stateLock sync.Mutex
+	current   entityState
+}
+
+func (l *LightsLcdHandler) Start(knob api.KnobConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
+	if l.Lock == nil {
+		l.Lock = semaphore.NewWeighted(1)
+	}
+	l.Quit = make(chan bool, 1)
+	l.Callback = callback
+	entityId, ok := firstEntityId(knob.LcdHandlerFields, knob.KnobOrTouchHandlerFields)
+	if !ok {
+		log.Println("Missing fields: entity_id")
+		return
+	}
+	backend, err := backendFromFields(knob.LcdHandlerFields, knob.SharedHandlerFields, knob.KnobOrTouchHandlerFields)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	l.FirstLoop = true
+	l.Running = true
+	go l.loop(knob, info, backend, entityId, l.Quit)
+}
+
+func (l *LightsLcdHandler) loop(knob api.KnobConfigV3, info api.StreamDeckInfoV1, backend lightBackend, entityId string, quit chan bool) {
+	ctx := context.Background()
+	err := l.Lock.Acquire(ctx, 1)
+	if err != nil {
+		return
+	}
+	defer l.Lock.Release(1)
+	sub := backend.subscribe(entityId)
+	defer sub.Close()
+	if state, err := backend.getState(entityId); err != nil {
+		log.Println(err)
+	} else {
+		sub.deliver(state)
+	}
+	mode := entityMode(entityId, modeFromFields(knob.LcdHandlerFields, knob.KnobOrTouchHandlerFields))
+	var sensor *sensorDisplay
+	var redraw <-chan time.Time
+	if mode == Sensor {
+		sensor = sensorFromFields(knob.LcdHandlerFields)
+		sensor.loadHistory(backend, entityId)
+		ticker := time.NewTicker(sensorRedrawInterval)
+		defer ticker.Stop()
+		redraw = ticker.C
+	}
+	var current entityState
+	for {
+		select {
+		case <-quit:
+			return
+		case <-redraw:
+			if current.EntityId != "" {
+				l.Callback(sensorLcdImage(sensor, current, knob.LcdHandlerFields, info.LcdWidth, info.LcdHeight))
+			}
+		case state := <-sub.C:
+			current = state
+			l.stateLock.Lock()
+			l.current = state
+			l.stateLock.Unlock()
+			sharedstate.Set(knob.SharedState, "state", state.State)
+			l.FirstLoop = false
+			if sensor != nil {
+				sensor.record(state)
+				l.Callback(sensorLcdImage(sensor, state, knob.LcdHandlerFields, info.LcdWidth, info.LcdHeight))
+				continue
+			}
+			l.Callback(lcdImage(state, mode, knob.LcdHandlerFields, info.LcdWidth, info.LcdHeight))
+		}
+	}
+}
+
+// currentState is the latest state of an entity the LCD is showing.
+func (l *LightsLcdHandler) currentState(entityId string) (entityState, bool) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return l.current, l.current.EntityId == entityId
+}
+
+func (l *LightsLcdHandler) IsRunning() bool {
+	return l.Running
+}
+
+func (l *LightsLcdHandler) SetRunning(running bool) {
+	l.Running = running
+}
+
+func (l *LightsLcdHandler) Stop() {
+	l.Running = false
+	select {
+	case l.Quit <- true:
+	default:
+	}
+}
+
+// lcdImage draws a swatch of the light's colour on the left of the segment,
+// with its name and the value the knob adjusts beside it.
+func lcdImage(state entityState, mode knobMode, fields map[string]any, width int, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	swatchSize := min(width/3, height) - api.BorderClearance
+	swatch := image.Rect(api.BorderClearance/2, (height-swatchSize)/2, api.BorderClearance/2+swatchSize, (height+swatchSize)/2)
+	draw.Draw(img, swatch, image.NewUniform(stateColour(state, mode)), image.Point{}, draw.Src)
+
+	textArea := image.NewRGBA(image.Rect(0, 0, width-swatch.Max.X, height))
+	name, ok := state.Attributes["friendly_name"].(string)
+	if !ok {
+		name = state.EntityId
+	}
+	fontFace, _ := fields["font_face"].(string)
+	textColour, _ := fields["text_colour"].(string)
+	text, err := api.DrawText(textArea, name+"\n"+modeText(state, mode), api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          fontFace,
+		Colour:            textColour,
+		FontSize:          int64(height / 5),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	draw.Draw(img, image.Rect(swatch.Max.X, 0, width, height), text, image.Point{}, draw.Over)
+	return img
+}
+
+func modeText(state entityState, mode knobMode) string {
+	switch mode {
+	case Temperature:
+		return climateText(state)
+	case Position:
+		return coverText(state)
+	}
+	if !isOn(state) {
+		return "Off"
+	}
+	switch mode {
+	case ColourTemp:
+		if kelvin, ok := state.Attributes["color_temp_kelvin"].(float64); ok {
+			return strconv.Itoa(int(kelvin)) + "K"
+		}
+	case Hue:
+		if hs, ok := state.Attributes["hs_color"].([]any); ok && len(hs) == 2 {
+			if hue, ok := hs[0].(float64); ok {
+				return strconv.Itoa(int(math.Round(hue))) + "°"
+			}
+		}
+	default:
+		return attributeText(state, "brightness")
+	}
+	return "On"
+}
+
+// stateColour is the light's current colour, scaled by its brightness, or
+// dark grey when it's off. Climate entities and covers have their own.
+func stateColour(state entityState, mode knobMode) color.NRGBA {
+	if c, ok := domainColour(state, mode); ok {
+		return c
+	}
+	off := color.NRGBA{R: 0x30, G: 0x30, B: 0x30, A: 0xff}
+	if !isOn(state) {
+		return off
+	}
+	c := color.NRGBA{R: 0xff, G: 0xd2, B: 0x8c, A: 0xff}
+	if rgb, ok := state.Attributes["rgb_color"].([]any); ok && len(rgb) == 3 {
+		channels := make([]uint8, 3)
+		for i, v := range rgb {
+			n, _ := v.(float64)
+			channels[i] = uint8(n)
+		}
+		c = color.NRGBA{R: channels[0], G: channels[1], B: channels[2], A: 0xff}
+	}
+	if brightness, ok := state.Attributes["brightness"].(float64); ok {
+		// Keep dim lights visible on the LCD
+		scale := 0.3 + 0.7*brightness/255
+		c.R = uint8(float64(c.R) * scale)
+		c.G = uint8(float64(c.G) * scale)
+		c.B = uint8(float64(c.B) * scale)
+	}
+	return c
+}
+
+func modeFromFields(sets ...map[string]any) knobMode {
+	name, _ := field("mode", sets...)
+	mode, ok := knobModes[name]
+	if !ok {
+		return Brightness
+	}
+	return mode
+}
+
+type LightsKnobOrTouchHandler struct {
+	lock    sync.Mutex
+	state   entityState
+	value   float64
+	valueAt time.Time
+	calls   throttle
+	// fetching is set while the state is read to start turning from, and
+	// pending holds the turns made in the meantime
+	fetching bool
+	pending  float64
+}
+
+func (l *LightsKnobOrTouchHandler) Input(knob api.KnobConfigV3, info api.StreamDeckInfoV1, event api.InputEvent) {
+	entityId, ok := firstEntityId(knob.KnobOrTouchHandlerFields, knob.LcdHandlerFields)
+	if !ok {
+		log.Println("Missing fields: entity_id")
+		return
+	}
+	backend, err := backendFromFields(knob.KnobOrTouchHandlerFields, knob.SharedHandlerFields, knob.LcdHandlerFields)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	mode := entityMode(entityId, modeFromFields(knob.KnobOrTouchHandlerFields, knob.LcdHandlerFields))
+	if mode == Sensor {
+		return
+	}
+	switch event.EventType {
+	case api.KNOB_PRESS, api.SCREEN_SHORT_TAP:
+		go func() {
+			err := press(backend, entityId, mode)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	case api.KNOB_CW, api.KNOB_CCW:
+		notches := float64(max(event.RotateNotches, 1))
+		if event.EventType == api.KNOB_CCW {
+			notches = -notches
+		}
+		var seed *entityState
+		if lcd, ok := knob.LcdHandlerStruct.(*LightsLcdHandler); ok {
+			if state, ok := lcd.currentState(entityId); ok {
+				seed = &state
+			}
+		}
+		l.turn(backend, entityId, mode, notches*knobStep(mode, knob.KnobOrTouchHandlerFields), seed)
+	}
+}
+
+// turn adjusts the knob's target value and queues a service call for it. The
+// target is tracked locally while the knob is turning, as the entity's state
+// lags behind the calls. It starts from the state seen by the LCD, if there
+// is one, or else fetches the state without holding up the knob's input.
+func (l *LightsKnobOrTouchHandler) turn(backend lightBackend, entityId string, mode knobMode, delta float64, seed *entityState) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.fetching {
+		l.pending += delta
+		return
+	}
+	if time.Since(l.valueAt) > knobValueTimeout || l.state.EntityId != entityId {
+		if seed == nil {
+			l.fetching = true
+			l.pending = delta
+			go l.fetch(backend, entityId, mode)
+			return
+		}
+		l.state = *seed
+		l.value = modeValue(*seed, mode)
+	}
+	l.adjust(backend, entityId, mode, delta)
+}
+
+// fetch reads the state to start turning from, then applies the turns made
+// while it was read.
+func (l *LightsKnobOrTouchHandler) fetch(backend lightBackend, entityId string, mode knobMode) {
+	state, err := backend.getState(entityId)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.fetching = false
+	delta := l.pending
+	l.pending = 0
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	l.state = state
+	l.value = modeValue(state, mode)
+	l.adjust(backend, entityId, mode, delta)
+}
+
+// adjust moves the target value by delta, with the lock held.
+func (l *LightsKnobOrTouchHandler) adjust(backend lightBackend, entityId string, mode knobMode, delta float64) {
+	state := l.state
+	l.value = clampModeValue(state, mode, l.value+delta)
+	l.valueAt = time.Now()
+	data := make(map[string]any)
+	switch mode {
+	case Temperature:
+		step, ok := state.Attributes["target_temp_step"].(float64)
+		if !ok {
+			step = 0.1
+		}
+		l.value = roundToStep(l.value, step)
+		temperature := l.value
+		l.calls.do(func() {
+			err := domainCall(backend, "climate", "set_temperature", map[string]any{"entity_id": entityId, "temperature": temperature})
+			if err != nil {
+				log.Println(err)
+			}
+		})
+		return
+	case Position:
+		position := int(l.value)
+		l.calls.do(func() {
+			err := domainCall(backend, "cover", "set_cover_position", map[string]any{"entity_id": entityId, "position": position})
+			if err != nil {
+				log.Println(err)
+			}
+		})
+		return
+	case ColourTemp:
+		data["color_temp_kelvin"] = int(l.value)
+	case Hue:
+		saturation := 100.0
+		if hs, ok := state.Attributes["hs_color"].([]any); ok && len(hs) == 2 {
+			if s, ok := hs[1].(float64); ok && s > 0 {
+				saturation = s
+			}
+		}
+		data["hs_color"] = []float64{l.value, saturation}
+	default:
+		data["brightness_pct"] = int(l.value)
+	}
+	l.calls.do(func() {
+		err := backend.turnOn(entityId, data)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func modeValue(state entityState, mode knobMode) float64 {
+	switch mode {
+	case Temperature:
+		target, _ := state.Attributes["temperature"].(float64)
+		return target
+	case Position:
+		position, _ := state.Attributes["current_position"].(float64)
+		return position
+	case ColourTemp:
+		kelvin, _ := state.Attributes["color_temp_kelvin"].(float64)
+		return kelvin
+	case Hue:
+		if hs, ok := state.Attributes["hs_color"].([]any); ok && len(hs) == 2 {
+			hue, _ := hs[0].(float64)
+			return hue
+		}
+		return 0
+	default:
+		brightness, _ := state.Attributes["brightness"].(float64)
+		return math.Round(brightness / 255 * 100)
+	}
+}
+
+func clampModeValue(state entityState, mode knobMode, value float64) float64 {
+	switch mode {
+	case Temperature:
+		minTemp, ok := state.Attributes["min_temp"].(float64)
+		if !ok {
+			minTemp = 7
+		}
+		maxTemp, ok := state.Attributes["max_temp"].(float64)
+		if !ok {
+			maxTemp = 35
+		}
+		return math.Max(minTemp, math.Min(maxTemp, value))
+	case ColourTemp:
+		minKelvin, ok := state.Attributes["min_color_temp_kelvin"].(float64)
+		if !ok {
+			minKelvin = 2000
+		}
+		maxKelvin, ok := state.Attributes["max_color_temp_kelvin"].(float64)
+		if !ok {
+			maxKelvin = 6500
+		}
+		return math.Max(minKelvin, math.Min(maxKelvin, value))
+	case Hue:
+		return math.Mod(value+360, 360)
+	default:
+		return math.Max(0, math.Min(100, value))
+	}
+}
+
+func knobStep(mode knobMode, fields map[string]any) float64 {
+	if step, ok := number.Field(fields["step"]); ok && step > 0 {
+		return step
+	}
+	switch mode {
+	case Temperature:
+		return 0.5
+	case ColourTemp:
+		return 100
+	case Hue:
+		return 10
+	default:
+		return 5
+	}
+}
+
+// throttle runs at most one function per interval. Functions queued while
+// waiting replace each other, so only the latest is run.
+type throttle struct {
+	lock    sync.Mutex
+	running sync.Mutex
+	pending func()
+	last    time.Time
+	timer   *time.Timer
+}
+
+func (t *throttle) do(f func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = f
+	if t.timer != nil {
+		return
+	}
+	wait := max(serviceCallInterval-time.Since(t.last), 0)
+	t.timer = time.AfterFunc(wait, t.flush)
+}
+
+func (t *throttle) flush() {
+	t.lock.Lock()
+	f := t.pending
+	t.pending = nil
+	t.timer = nil
+	t.last = time.Now()
+	t.lock.Unlock()
+	if f == nil {
+		return
+	}
+	// Keep calls in order if one is slower than the interval
+	t.running.Lock()
+	defer t.running.Unlock()
+	f()
+}
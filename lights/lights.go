@@ -1,66 +1,110 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"log"
-	"net/http"
 
 	"github.com/unix-streamdeck/api/v2"
+	"golang.org/x/sync/semaphore"
 )
 
 type LightsKeyHandler struct{}
 
 func (LightsKeyHandler) Key(key api.KeyConfigV3, info api.StreamDeckInfoV1) {
-	entityId, ok := key.KeyHandlerFields["entity_id"]
-	if !ok {
+	// A status key has nothing to call, pressing it checks again
+	if handler, ok := key.IconHandlerStruct.(*LightsIconHandler); ok && key.IconHandler == "Lights" && handler.refresh != nil {
+		handler.Refresh()
 		return
 	}
-	reqBody, err := json.Marshal(map[string]string{
-		"entity_id": entityId.(string),
-	})
+	backend, err := backendFromFields(key.KeyHandlerFields, key.SharedHandlerFields)
 	if err != nil {
-		print(err)
-		return
-	}
-	apiKey, ok := key.KeyHandlerFields["api_key"]
-	if !ok {
-		return
-	}
-	domain, ok := key.KeyHandlerFields["domain"]
-	if !ok {
-		return
-	}
-	service, ok := key.KeyHandlerFields["service"]
-	if !ok {
-		return
-	}
-	baseUrl, ok := key.KeyHandlerFields["base_url"]
-	if !ok {
+		log.Println(err)
+		showFeedback(key, "error", "Config")
 		return
 	}
-	req, err := http.NewRequest("POST", "http://"+baseUrl.(string)+"/api/services/"+domain.(string)+"/"+service.(string), bytes.NewBuffer(reqBody))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey.(string))
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = backend.action(key.KeyHandlerFields)
 	if err != nil {
 		log.Println(err)
+		showFeedback(key, "error", errorText(err))
+		return
+	}
+	if showSuccess, _ := key.KeyHandlerFields["show_success"].(string); showSuccess == "true" {
+		showFeedback(key, "success", "")
 	}
-	defer resp.Body.Close()
 }
 
-func GetModule() api.Module {
+// The free text field lists, which the picker copies to add the domains,
+// services and entities it finds as selections.
+var iconFields = []api.Field{
+	{Title: "Entity Id", Name: "entity_id", Type: api.Text},
+	{Title: "On Icon", Name: "on_icon", Type: api.File, FileTypes: []string{".png", ".jpg", ".jpeg"}},
+	{Title: "Off Icon", Name: "off_icon", Type: api.File, FileTypes: []string{".png", ".jpg", ".jpeg"}},
+	{Title: "On Label", Name: "on_label", Type: api.Text},
+	{Title: "Off Label", Name: "off_label", Type: api.Text},
+	{Title: "On Background", Name: "on_background", Type: api.Colour},
+	{Title: "Off Background", Name: "off_background", Type: api.Colour},
+	{Title: "Text Colour", Name: "text_colour", Type: api.Colour},
+	{Title: "Font Face", Name: "font_face", Type: api.FontFace},
+	{Title: "Attribute", Name: "attribute", Type: api.Text},
+	{Title: "Display", Name: "display", Type: api.Select, ListItems: []string{"state", "sensor", "status"}},
+	{Title: "Decimals", Name: "decimals", Type: api.Number},
+	{Title: "Thresholds", Name: "thresholds", Type: api.Text},
+	{Title: "History (Hours)", Name: "history_hours", Type: api.Number},
+}
+
+var keyFields = []api.Field{
+	{Title: "Domain", Name: "domain", Type: api.Text},
+	{Title: "Service", Name: "service", Type: api.Text},
+	{Title: "Entity Id", Name: "entity_id", Type: api.Text},
+	{Title: "Area Id", Name: "area_id", Type: api.Text},
+	{Title: "Device Id", Name: "device_id", Type: api.Text},
+	{Title: "Service Data", Name: "service_data", Type: api.Text},
+	{Title: "Show Success", Name: "show_success", Type: api.Select, ListItems: []string{"false", "true"}},
+}
 
+var lcdFields = []api.Field{
+	{Title: "Entity Id", Name: "entity_id", Type: api.Text},
+	{Title: "Mode", Name: "mode", Type: api.Select, ListItems: []string{"brightness", "color_temp", "hue", "sensor"}},
+	{Title: "Text Colour", Name: "text_colour", Type: api.Colour},
+	{Title: "Font Face", Name: "font_face", Type: api.FontFace},
+	{Title: "Decimals", Name: "decimals", Type: api.Number},
+	{Title: "Thresholds", Name: "thresholds", Type: api.Text},
+	{Title: "History (Hours)", Name: "history_hours", Type: api.Number},
+}
+
+var knobOrTouchFields = []api.Field{
+	{Title: "Entity Id", Name: "entity_id", Type: api.Text},
+	{Title: "Mode", Name: "mode", Type: api.Select, ListItems: []string{"brightness", "color_temp", "hue", "sensor"}},
+	{Title: "Step", Name: "step", Type: api.Number},
+}
+
+var linkedFields = []api.Field{
+	{Title: "Backend", Name: "backend", Type: api.Select, ListItems: []string{"home_assistant", "hue"}},
+	{Title: "Api Key", Name: "api_key", Type: api.Text},
+	{Title: "Base Url", Name: "base_url", Type: api.Text},
+	{Title: "CA Bundle", Name: "ca_file", Type: api.File, FileTypes: []string{".pem", ".crt"}},
+	{Title: "Skip TLS Verification", Name: "insecure_skip_verify", Type: api.Select, ListItems: []string{"false", "true"}},
+	{Title: "Timeout (Seconds)", Name: "timeout", Type: api.Number},
+	{Title: "Hue Bridge Address", Name: "bridge_address", Type: api.Text},
+	{Title: "Hue App Key", Name: "app_key", Type: api.Text},
+}
+
+func GetModule() api.Module {
+	startPicker()
+	fields := moduleFields()
 	return api.Module{
-		Name:   "Lights",
-		NewKey: func() api.KeyHandler { return &LightsKeyHandler{} },
-		KeyFields: []api.Field{
-			{Title: "Domain", Name: "domain", Type: api.Text},
-			{Title: "Service", Name: "service", Type: api.Text},
-			{Title: "Entity Id", Name: "entity_id", Type: api.Text},
-			{Title: "Api Key", Name: "api_key", Type: api.Text},
-			{Title: "Base Url", Name: "base_url", Type: api.Text},
+		Name: "Lights",
+		NewIcon: func() api.IconHandler {
+			return &LightsIconHandler{Running: true, Lock: semaphore.NewWeighted(1), FirstLoop: true}
+		},
+		NewKey:     func() api.KeyHandler { return &LightsKeyHandler{} },
+		IconFields: fields.Icon,
+		KeyFields:  fields.Key,
+		NewLcd: func() api.LcdHandler {
+			return &LightsLcdHandler{Running: true, Lock: semaphore.NewWeighted(1), FirstLoop: true}
 		},
+		LcdFields:         fields.Lcd,
+		NewKnobOrTouch:    func() api.KnobOrTouchHandler { return &LightsKnobOrTouchHandler{} },
+		KnobOrTouchFields: fields.KnobOrTouch,
+		LinkedFields:      linkedFields,
 	}
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+)
+
+// The picker offers what it finds in Home Assistant as selections. The key
+// handler's Domain field becomes a selection, and each domain with entities
+// gets a "<domain>_service" and "<domain>_entity" selection, which the key
+// handler reads for its configured domain. The icon, LCD and knob handlers get
+// an "entity" selection. The free text Service and Entity ID fields stay, and
+// win when set, as they can hold several entities or a Hue resource path.
+//
+// The field lists handed to the daemon are never changed. Each refresh
+// publishes new lists, which GetModule returns from then on.
+
+const (
+	pickerRefreshInterval = 5 * time.Minute
+	pickerRetryInterval   = 30 * time.Second
+)
+
+var pickerOnce sync.Once
+
+// knobDomains are the entity domains the knob and LCD handlers can control.
+var knobDomains = []string{"light", "climate", "cover"}
+
+type serviceDomain struct {
+	Domain   string         `json:"domain"`
+	Services map[string]any `json:"services"`
+}
+
+// handlerFields are the field lists of each handler.
+type handlerFields struct {
+	Icon        []api.Field
+	Key         []api.Field
+	Lcd         []api.Field
+	KnobOrTouch []api.Field
+}
+
+// pickerFields holds the lists from the last successful refresh, if any.
+var pickerFields atomic.Pointer[handlerFields]
+
+// moduleFields are the field lists to give the daemon: the picker's, or the
+// free text fields until Home Assistant has been reached.
+func moduleFields() handlerFields {
+	if fields := pickerFields.Load(); fields != nil {
+		return *fields
+	}
+	return handlerFields{Icon: iconFields, Key: keyFields, Lcd: lcdFields, KnobOrTouch: knobOrTouchFields}
+}
+
+// startPicker starts refreshing the picker in the background, once.
+func startPicker() {
+	pickerOnce.Do(func() { go refreshPicker() })
+}
+
+// refreshPicker keeps the lists up to date, backing off while Home Assistant
+// can't be reached and logging each new error once.
+func refreshPicker() {
+	delay := pickerRetryInterval
+	lastErr := ""
+	for {
+		err := updatePicker()
+		if err == nil {
+			delay = pickerRetryInterval
+			lastErr = ""
+			time.Sleep(pickerRefreshInterval)
+			continue
+		}
+		if err.Error() != lastErr {
+			log.Println("Lights picker:", err)
+			lastErr = err.Error()
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, pickerRefreshInterval)
+	}
+}
+
+func updatePicker() error {
+	conn, err := pickerConnection()
+	if err != nil {
+		return err
+	}
+	var domains []serviceDomain
+	if err := conn.getJSON("/api/services", &domains); err != nil {
+		return err
+	}
+	var states []entityState
+	if err := conn.getJSON("/api/states", &states); err != nil {
+		return err
+	}
+	fields := pickerFieldLists(domains, states)
+	pickerFields.Store(&fields)
+	return nil
+}
+
+// pickerFieldLists builds new field lists with the domains, services and
+// entities as selections.
+func pickerFieldLists(domains []serviceDomain, states []entityState) handlerFields {
+	services := make(map[string][]string)
+	for _, domain := range domains {
+		for service := range domain.Services {
+			services[domain.Domain] = append(services[domain.Domain], service)
+		}
+	}
+	var all, knob []string
+	entities := make(map[string][]string)
+	for _, state := range states {
+		domain, _, _ := strings.Cut(state.EntityId, ".")
+		all = append(all, state.EntityId)
+		entities[domain] = append(entities[domain], state.EntityId)
+		if slices.Contains(knobDomains, domain) {
+			knob = append(knob, state.EntityId)
+		}
+	}
+
+	// Only domains with both services and entities get selections of their
+	// own, others take the free text fields
+	var domainNames, picked []string
+	for domain := range services {
+		domainNames = append(domainNames, domain)
+		if len(entities[domain]) > 0 {
+			picked = append(picked, domain)
+		}
+	}
+	slices.Sort(picked)
+	var perDomain []api.Field
+	for _, domain := range picked {
+		perDomain = append(perDomain,
+			api.Field{Title: "Service (" + domain + ")", Name: domain + "_service", Type: api.Select, ListItems: sortedItems(services[domain])},
+			api.Field{Title: "Entity (" + domain + ")", Name: domain + "_entity", Type: api.Select, ListItems: sortedItems(entities[domain])},
+		)
+	}
+
+	key := withSelect(keyFields, "domain", domainNames)
+	key = insertAfter(key, "entity_id", perDomain...)
+	return handlerFields{
+		Icon: insertAfter(iconFields, "entity_id", entitySelect(all)...),
+		Key:  key,
+		// The LCD can show any entity as a sensor
+		Lcd:         insertAfter(lcdFields, "entity_id", entitySelect(all)...),
+		KnobOrTouch: insertAfter(knobOrTouchFields, "entity_id", entitySelect(knob)...),
+	}
+}
+
+func entitySelect(entities []string) []api.Field {
+	if len(entities) == 0 {
+		return nil
+	}
+	return []api.Field{{Title: "Entity", Name: "entity", Type: api.Select, ListItems: sortedItems(entities)}}
+}
+
+// withSelect copies the fields, turning the named one into a selection.
+func withSelect(fields []api.Field, name string, items []string) []api.Field {
+	fields = slices.Clone(fields)
+	if len(items) == 0 {
+		return fields
+	}
+	for i := range fields {
+		if fields[i].Name == name {
+			fields[i].Type = api.Select
+			fields[i].ListItems = sortedItems(items)
+		}
+	}
+	return fields
+}
+
+// insertAfter copies the fields, with extra fields after the named one.
+func insertAfter(fields []api.Field, name string, extra ...api.Field) []api.Field {
+	i := slices.IndexFunc(fields, func(f api.Field) bool { return f.Name == name })
+	return slices.Insert(slices.Clone(fields), i+1, extra...)
+}
+
+func sortedItems(items []string) []string {
+	items = slices.Clone(items)
+	slices.Sort(items)
+	return slices.Compact(items)
+}
+
+// pickerConnection finds a Home Assistant instance to populate the picker
+// from, either from the HASS_SERVER and HASS_TOKEN environment variables, or
+// the first Lights handler in the daemon's config.
+func pickerConnection() (hassConnection, error) {
+	if server, token := os.Getenv("HASS_SERVER"), os.Getenv("HASS_TOKEN"); server != "" && token != "" {
+		return connectionFromFields(map[string]any{"base_url": server, "api_key": token})
+	}
+	conn, err := api.Connect()
+	if err != nil {
+		return hassConnection{}, err
+	}
+	defer conn.Close()
+	config, err := conn.GetConfig()
+	if err != nil {
+		return hassConnection{}, err
+	}
+	for _, deck := range config.Decks {
+		for _, page := range deck.Pages {
+			for _, key := range page.Keys {
+				for _, k := range key.Application {
+					if k.KeyHandler != "Lights" && k.IconHandler != "Lights" {
+						continue
+					}
+					hass, err := connectionFromFields(k.KeyHandlerFields, k.SharedHandlerFields, k.IconHandlerFields)
+					if err == nil {
+						return hass, nil
+					}
+				}
+			}
+			for _, knob := range page.Knobs {
+				for _, k := range knob.Application {
+					if k.KnobOrTouchHandler != "Lights" && k.LcdHandler != "Lights" {
+						continue
+					}
+					hass, err := connectionFromFields(k.KnobOrTouchHandlerFields, k.SharedHandlerFields, k.LcdHandlerFields)
+					if err == nil {
+						return hass, nil
+					}
+				}
+			}
+		}
+	}
+	return hassConnection{}, errors.New("no Home Assistant connection configured")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/unix-streamdeck/api/v2"
+)
+
+func findField(fields []api.Field, name string) (api.Field, bool) {
+	i := slices.IndexFunc(fields, func(f api.Field) bool { return f.Name == name })
+	if i < 0 {
+		return api.Field{}, false
+	}
+	return fields[i], true
+}
+
+func TestPickerFieldLists(t *testing.T) {
+	before := moduleFields()
+	iconBefore := slices.Clone(iconFields)
+	keyBefore := slices.Clone(keyFields)
+	domains := []serviceDomain{
+		{Domain: "light", Services: map[string]any{"turn_on": nil, "toggle": nil}},
+		{Domain: "switch", Services: map[string]any{"toggle": nil}},
+		{Domain: "notify", Services: map[string]any{"mobile_app": nil}},
+	}
+	states := []entityState{{EntityId: "light.desk"}, {EntityId: "switch.fan"}, {EntityId: "sensor.temperature"}, {EntityId: "light.hall"}}
+	fields := pickerFieldLists(domains, states)
+
+	// The lists already handed to the daemon are left alone
+	if !reflect.DeepEqual(iconFields, iconBefore) || !reflect.DeepEqual(keyFields, keyBefore) || !reflect.DeepEqual(moduleFields(), before) {
+		t.Fatal("building the picker's lists changed the published ones")
+	}
+
+	domain, _ := findField(fields.Key, "domain")
+	if domain.Type != api.Select || !reflect.DeepEqual(domain.ListItems, []string{"light", "notify", "switch"}) {
+		t.Fatalf("domain field %+v", domain)
+	}
+	services, _ := findField(fields.Key, "light_service")
+	if services.Type != api.Select || !reflect.DeepEqual(services.ListItems, []string{"toggle", "turn_on"}) {
+		t.Fatalf("light services %+v", services)
+	}
+	entities, _ := findField(fields.Key, "switch_entity")
+	if !reflect.DeepEqual(entities.ListItems, []string{"switch.fan"}) {
+		t.Fatalf("switch entities %+v", entities)
+	}
+	// A domain without entities, or without services, has no selections
+	for _, name := range []string{"notify_service", "sensor_entity"} {
+		if _, ok := findField(fields.Key, name); ok {
+			t.Fatalf("unexpected field %s", name)
+		}
+	}
+	// Free text stays as the fallback
+	for _, name := range []string{"service", "entity_id"} {
+		if f, ok := findField(fields.Key, name); !ok || f.Type != api.Text {
+			t.Fatalf("free text %s field %+v", name, f)
+		}
+	}
+
+	icon, _ := findField(fields.Icon, "entity")
+	if len(icon.ListItems) != 4 {
+		t.Fatalf("icon entities %v", icon.ListItems)
+	}
+	knob, _ := findField(fields.KnobOrTouch, "entity")
+	if !reflect.DeepEqual(knob.ListItems, []string{"light.desk", "light.hall"}) {
+		t.Fatalf("knob entities %v", knob.ListItems)
+	}
+}
+
+func TestActionReadsPickedFields(t *testing.T) {
+	var path string
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+	conn := hassConnection{BaseUrl: server.URL}
+
+	err := conn.action(map[string]any{"domain": "light", "light_service": "turn_on", "light_entity": "light.desk", "switch_entity": "switch.fan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/services/light/turn_on" || body["entity_id"] != "light.desk" {
+		t.Fatalf("called %s with %v", path, body)
+	}
+
+	// Free text wins over the selections
+	err = conn.action(map[string]any{"domain": "light", "service": "toggle", "light_service": "turn_on", "entity_id": "light.a, light.b", "light_entity": "light.desk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/services/light/toggle" || !reflect.DeepEqual(body["entity_id"], []any{"light.a", "light.b"}) {
+		t.Fatalf("called %s with %v", path, body)
+	}
+
+	if id, _ := firstEntityId(map[string]any{"entity": "sensor.temperature"}); id != "sensor.temperature" {
+		t.Fatalf("picked entity %q", id)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/number"
+	"streamdeckd-modules/internal/render"
+)
+
+// sensorRedrawInterval is how often a sensor is redrawn without a change,
+// so its sparkline keeps moving.
+const sensorRedrawInterval = time.Minute
+
+// threshold colours the background once a sensor reaches its value, or, for
+// states that aren't numbers, when the state matches it.
+type threshold struct {
+	Value   float64
+	State   string
+	Numeric bool
+	Colour  color.NRGBA
+}
+
+type sensorPoint struct {
+	Value float64
+	At    time.Time
+}
+
+// sensorDisplay draws an entity's state with its unit, and the history of
+// numeric states as a sparkline.
+type sensorDisplay struct {
+	// Decimals is the number of decimals shown, or -1 to show the state as
+	// Home Assistant reports it
+	Decimals   int
+	Thresholds []threshold
+	// Window is how much history the sparkline covers, none if 0
+	Window time.Duration
+
+	lock    sync.Mutex
+	history []sensorPoint
+}
+
+func sensorFromFields(fields map[string]any) *sensorDisplay {
+	s := &sensorDisplay{Decimals: -1}
+	if decimals, ok := number.Field(fields["decimals"]); ok && decimals >= 0 {
+		s.Decimals = int(decimals)
+	}
+	if hours, ok := number.Field(fields["history_hours"]); ok && hours > 0 {
+		s.Window = time.Duration(hours * float64(time.Hour))
+	}
+	if raw, ok := fields["thresholds"].(string); ok {
+		s.Thresholds = parseThresholds(raw)
+	}
+	return s
+}
+
+// parseThresholds reads value=colour pairs separated by commas or new lines,
+// e.g. "18=#3366ff, 24=#33aa33, 28=#ff3300" or "open=#ff0000".
+func parseThresholds(raw string) []threshold {
+	var thresholds []threshold
+	for _, pair := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		key, hex, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Println("Invalid threshold:", pair)
+			continue
+		}
+		colour, err := render.ParseColour(strings.TrimSpace(hex))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		t := threshold{State: strings.TrimSpace(key), Colour: colour}
+		if value, err := strconv.ParseFloat(t.State, 64); err == nil {
+			t.Value = value
+			t.Numeric = true
+		}
+		thresholds = append(thresholds, t)
+	}
+	sort.SliceStable(thresholds, func(i, j int) bool {
+		if thresholds[i].Numeric != thresholds[j].Numeric {
+			return thresholds[i].Numeric
+		}
+		return thresholds[i].Numeric && thresholds[i].Value < thresholds[j].Value
+	})
+	return thresholds
+}
+
+// background is the colour of the highest threshold the state has reached, or
+// of the threshold matching it.
+func (s *sensorDisplay) background(state entityState) (color.NRGBA, bool) {
+	value, err := strconv.ParseFloat(state.State, 64)
+	numeric := err == nil
+	var colour color.NRGBA
+	found := false
+	for _, t := range s.Thresholds {
+		if t.Numeric && numeric && value >= t.Value {
+			colour, found = t.Colour, true
+		} else if !t.Numeric && strings.EqualFold(t.State, state.State) {
+			return t.Colour, true
+		}
+	}
+	return colour, found
+}
+
+// text is the state with its unit, rounded to the configured decimals.
+func (s *sensorDisplay) text(state entityState) string {
+	text := state.State
+	if value, err := strconv.ParseFloat(state.State, 64); err == nil && s.Decimals >= 0 {
+		text = strconv.FormatFloat(value, 'f', s.Decimals, 64)
+	}
+	if unit, ok := state.Attributes["unit_of_measurement"].(string); ok && unit != "" {
+		if unit == "%" || strings.HasPrefix(unit, "°") {
+			return text + unit
+		}
+		return text + " " + unit
+	}
+	return text
+}
+
+// loadHistory fills the sparkline from Home Assistant's recorder. Other
+// backends keep no history, so theirs starts from the states seen live.
+func (s *sensorDisplay) loadHistory(backend lightBackend, entityId string) {
+	conn, ok := backend.(hassConnection)
+	if s.Window == 0 || !ok {
+		return
+	}
+	start := time.Now().Add(-s.Window).UTC().Format(time.RFC3339)
+	query := url.Values{"filter_entity_id": {entityId}, "minimal_response": {""}, "no_attributes": {""}}
+	var history [][]entityState
+	err := conn.getJSON("/api/history/period/"+url.PathEscape(start)+"?"+query.Encode(), &history)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, states := range history {
+		for _, state := range states {
+			s.appendLocked(state)
+		}
+	}
+}
+
+// record adds a live state to the sparkline.
+func (s *sensorDisplay) record(state entityState) {
+	if s.Window == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if state.LastChanged.IsZero() {
+		state.LastChanged = time.Now()
+	}
+	s.appendLocked(state)
+}
+
+func (s *sensorDisplay) appendLocked(state entityState) {
+	value, err := strconv.ParseFloat(state.State, 64)
+	if err != nil {
+		return
+	}
+	n := len(s.history)
+	if n > 0 && !state.LastChanged.After(s.history[n-1].At) {
+		return
+	}
+	s.history = append(s.history, sensorPoint{Value: value, At: state.LastChanged})
+	// Keep the last point before the window, as the sparkline starts at its
+	// value
+	cutoff := time.Now().Add(-s.Window)
+	drop := 0
+	for drop+1 < len(s.history) && !s.history[drop+1].At.After(cutoff) {
+		drop++
+	}
+	s.history = s.history[drop:]
+}
+
+// image draws the sensor's value over its threshold colour, with the
+// sparkline below it.
+func (s *sensorDisplay) image(state entityState, fields map[string]any, width int, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	background := color.NRGBA{A: 0xff}
+	if colour, ok := s.background(state); ok {
+		background = colour
+	}
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	textColour, _ := fields["text_colour"].(string)
+	alignment := api.Center
+	if s.drawSparkline(img, image.Rect(api.BorderClearance/2, height*3/5, width-api.BorderClearance/2, height-api.BorderClearance/2), lineColour(textColour)) {
+		alignment = api.Top
+	}
+	fontFace, _ := fields["font_face"].(string)
+	labelled, err := api.DrawText(img, s.text(state), api.DrawTextOptions{
+		VerticalAlignment: alignment,
+		FontFace:          fontFace,
+		Colour:            textColour,
+		FontSize:          int64(height / 4),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
+
+// drawSparkline plots the history as a step line across the rectangle, and
+// reports whether there was enough of it to draw.
+func (s *sensorDisplay) drawSparkline(img draw.Image, r image.Rectangle, colour color.Color) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.Window == 0 || len(s.history) < 2 || r.Dx() < 2 || r.Dy() < 2 {
+		return false
+	}
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, p := range s.history {
+		low = math.Min(low, p.Value)
+		high = math.Max(high, p.Value)
+	}
+	if high == low {
+		high, low = high+1, low-1
+	}
+	now := time.Now()
+	start := now.Add(-s.Window)
+	i := 0
+	previous := -1
+	for x := r.Min.X; x < r.Max.X; x++ {
+		at := start.Add(time.Duration(float64(s.Window) * float64(x-r.Min.X) / float64(r.Dx()-1)))
+		for i+1 < len(s.history) && !s.history[i+1].At.After(at) {
+			i++
+		}
+		if s.history[i].At.After(at) {
+			continue
+		}
+		y := r.Max.Y - 1 - int(math.Round((s.history[i].Value-low)/(high-low)*float64(r.Dy()-1)))
+		from, to := y, y
+		if previous >= 0 {
+			from, to = min(previous, y), max(previous, y)
+		}
+		for yy := from; yy <= to; yy++ {
+			img.Set(x, yy, colour)
+		}
+		previous = y
+	}
+	return true
+}
+
+// lineColour is the sparkline's colour, the text colour if set.
+func lineColour(textColour string) color.NRGBA {
+	if textColour != "" {
+		if c, err := render.ParseColour(textColour); err == nil {
+			return c
+		}
+	}
+	return color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+}
+
+// sensorLcdImage draws the sensor's name and value on the left of the
+// segment, and its sparkline on the right.
+func sensorLcdImage(sensor *sensorDisplay, state entityState, fields map[string]any, width int, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	background := color.NRGBA{A: 0xff}
+	if colour, ok := sensor.background(state); ok {
+		background = colour
+	}
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	textColour, _ := fields["text_colour"].(string)
+	textWidth := width
+	spark := image.Rect(width/2, api.BorderClearance, width-api.BorderClearance/2, height-api.BorderClearance)
+	if sensor.drawSparkline(img, spark, lineColour(textColour)) {
+		textWidth = width / 2
+	}
+	name, ok := state.Attributes["friendly_name"].(string)
+	if !ok {
+		name = state.EntityId
+	}
+	fontFace, _ := fields["font_face"].(string)
+	text, err := api.DrawText(image.NewRGBA(image.Rect(0, 0, textWidth, height)), name+"\n"+sensor.text(state), api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          fontFace,
+		Colour:            textColour,
+		FontSize:          int64(height / 5),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	draw.Draw(img, image.Rect(0, 0, textWidth, height), text, image.Point{}, draw.Over)
+	return img
+}
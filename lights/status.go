@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/sharedstate"
+)
+
+// statusInterval is how often the status icon checks Home Assistant.
+const statusInterval = 30 * time.Second
+
+// hassStatus is the result of checking a Home Assistant instance.
+type hassStatus struct {
+	// Kind is "connected", "auth" if the token was refused, "unreachable"
+	// or "config" if the connection fields are incomplete
+	Kind    string
+	Latency time.Duration
+	Version string
+	Err     error
+}
+
+// checkStatus calls /api/, which needs a valid token, timing the round trip,
+// then reads the version from /api/config.
+func checkStatus(conn hassConnection) hassStatus {
+	start := time.Now()
+	resp, err := conn.request("GET", "/api/", nil)
+	if err != nil {
+		var status *statusError
+		if errors.As(err, &status) && (status.StatusCode == http.StatusUnauthorized || status.StatusCode == http.StatusForbidden) {
+			return hassStatus{Kind: "auth", Err: err}
+		}
+		return hassStatus{Kind: "unreachable", Err: err}
+	}
+	resp.Body.Close()
+	latency := time.Since(start)
+	var config struct {
+		Version string `json:"version"`
+	}
+	err = conn.getJSON("/api/config", &config)
+	if err != nil {
+		log.Println(err)
+	}
+	return hassStatus{Kind: "connected", Latency: latency, Version: config.Version}
+}
+
+// text is what the icon shows for the status.
+func (s hassStatus) text() string {
+	switch s.Kind {
+	case "connected":
+		latency := strconv.FormatInt(s.Latency.Milliseconds(), 10) + " ms"
+		if s.Version == "" {
+			return "HA\n" + latency
+		}
+		return "HA\n" + s.Version + "\n" + latency
+	case "auth":
+		return "HA\nAuth\nFailed"
+	case "config":
+		return "HA\nConfig"
+	}
+	if errorText(s.Err) == "Timeout" {
+		return "HA\nTimeout"
+	}
+	return "HA\nOffline"
+}
+
+func (s hassStatus) colour() color.NRGBA {
+	switch s.Kind {
+	case "connected":
+		return color.NRGBA{R: 0x20, G: 0x80, B: 0x30, A: 0xff}
+	case "auth", "config":
+		return color.NRGBA{R: 0xc0, G: 0x20, B: 0x20, A: 0xff}
+	}
+	return color.NRGBA{R: 0x50, G: 0x50, B: 0x50, A: 0xff}
+}
+
+func (s hassStatus) image(fields map[string]any, size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(s.colour()), image.Point{}, draw.Src)
+	fontFace, _ := fields["font_face"].(string)
+	textColour, _ := fields["text_colour"].(string)
+	labelled, err := api.DrawText(img, s.text(), api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          fontFace,
+		Colour:            textColour,
+		FontSize:          int64(size / 5),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
+
+func (c *LightsIconHandler) startStatus(k api.KeyConfigV3, info api.StreamDeckInfoV1) {
+	c.refresh = make(chan struct{}, 1)
+	conn, err := connectionFromFields(k.IconHandlerFields, k.SharedHandlerFields, k.KeyHandlerFields)
+	if err != nil {
+		log.Println(err)
+		c.draw(hassStatus{Kind: "config", Err: err}.image(k.IconHandlerFields, info.IconSize))
+		return
+	}
+	c.FirstLoop = true
+	c.Running = true
+	go c.statusLoop(k, conn, info.IconSize, c.Quit)
+}
+
+// statusLoop shows the health of the connection until stopped, checking
+// again straight away when the key is pressed.
+func (c *LightsIconHandler) statusLoop(k api.KeyConfigV3, conn hassConnection, size int, quit chan bool) {
+	ctx := context.Background()
+	err := c.Lock.Acquire(ctx, 1)
+	if err != nil {
+		return
+	}
+	defer c.Lock.Release(1)
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	var last string
+	for {
+		status := checkStatus(conn)
+		if status.Kind != last && status.Err != nil {
+			log.Println("Home Assistant status:", status.Err)
+		}
+		last = status.Kind
+		c.FirstLoop = false
+		sharedstate.Set(k.SharedState, "state", status.Kind)
+		c.draw(status.image(k.IconHandlerFields, size))
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		case <-c.refresh:
+		}
+	}
+}
+
+// Refresh checks the status again now, rather than at the next interval.
+func (c *LightsIconHandler) Refresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
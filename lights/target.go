@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// targetFields are the fields that select what a service call acts on. Each
+// can hold several comma separated IDs.
+var targetFields = []string{"entity_id", "area_id", "device_id"}
+
+// serviceData builds the body of a service call from the key's targets and
+// its service data field, which is either a JSON object or key=value pairs
+// separated by commas or new lines.
+func serviceData(fields map[string]any) (map[string]any, error) {
+	data := make(map[string]any)
+	if raw, ok := fields["service_data"].(string); ok && strings.TrimSpace(raw) != "" {
+		parsed, err := parseServiceData(raw)
+		if err != nil {
+			return nil, err
+		}
+		data = parsed
+	}
+	for _, name := range targetFields {
+		ids := splitIds(fields[name])
+		if name == "entity_id" {
+			ids = entityIds(fields)
+		}
+		if len(ids) == 1 {
+			data[name] = ids[0]
+		} else if len(ids) > 1 {
+			data[name] = ids
+		}
+	}
+	return data, nil
+}
+
+func parseServiceData(raw string) (map[string]any, error) {
+	raw = strings.TrimSpace(raw)
+	data := make(map[string]any)
+	if strings.HasPrefix(raw, "{") {
+		err := json.Unmarshal([]byte(raw), &data)
+		return data, err
+	}
+	for _, pair := range splitPairs(raw) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.New("invalid service data, expected key=value: " + pair)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		// Numbers, lists and booleans are passed as JSON, anything else as a string
+		var parsed any
+		if err := json.Unmarshal([]byte(value), &parsed); err == nil {
+			data[key] = parsed
+		} else {
+			data[key] = value
+		}
+	}
+	return data, nil
+}
+
+// splitPairs splits key=value pairs on new lines and commas, except commas
+// inside a JSON list such as rgb_color=[255,0,0].
+func splitPairs(raw string) []string {
+	var pairs []string
+	depth := 0
+	start := 0
+	for i, r := range raw {
+		switch r {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',', '\n':
+			if depth > 0 {
+				continue
+			}
+			pairs = append(pairs, raw[start:i])
+			start = i + 1
+		}
+	}
+	pairs = append(pairs, raw[start:])
+	var nonEmpty []string
+	for _, pair := range pairs {
+		if strings.TrimSpace(pair) != "" {
+			nonEmpty = append(nonEmpty, pair)
+		}
+	}
+	return nonEmpty
+}
+
+func splitIds(value any) []string {
+	raw, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	var ids []string
+	for _, id := range strings.Split(raw, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// entityIds reads the entities a handler's fields target: the free text
+// Entity ID field, or else the entity picked from the picker's selection, which
+// for the key handler is the one for its domain.
+func entityIds(fields map[string]any) []string {
+	if ids := splitIds(fields["entity_id"]); len(ids) > 0 {
+		return ids
+	}
+	if ids := splitIds(fields["entity"]); len(ids) > 0 {
+		return ids
+	}
+	if domain, ok := field("domain", fields); ok {
+		return splitIds(fields[domain+"_entity"])
+	}
+	return nil
+}
+
+// firstEntityId picks the entity to show from fields that may target several.
+func firstEntityId(sets ...map[string]any) (string, bool) {
+	for _, set := range sets {
+		if ids := entityIds(set); len(ids) > 0 {
+			return ids[0], true
+		}
+	}
+	return "", false
+}
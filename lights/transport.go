@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"streamdeckd-modules/internal/number"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// transportOptions are the TLS and timeout settings of a connection. Every
+// connection with the same options shares one HTTP client, and so its pool of
+// keep-alive connections.
+type transportOptions struct {
+	CaFile   string
+	Insecure bool
+	Timeout  time.Duration
+}
+
+var (
+	clientsLock sync.Mutex
+	clients     = make(map[transportOptions]*http.Client)
+)
+
+func (o transportOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.Insecure}
+	if o.CaFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(o.CaFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + o.CaFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+func (o transportOptions) client() (*http.Client, error) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	if client, ok := clients[o]; ok {
+		return client, nil
+	}
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: transport, Timeout: o.Timeout}
+	clients[o] = client
+	return client, nil
+}
+
+func (o transportOptions) dialer() (*websocket.Dialer, error) {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: o.Timeout,
+		TLSClientConfig:  tlsConfig,
+	}, nil
+}
+
+func transportFromFields(sets ...map[string]any) transportOptions {
+	options := transportOptions{Timeout: defaultTimeout}
+	options.CaFile, _ = field("ca_file", sets...)
+	insecure, _ := field("insecure_skip_verify", sets...)
+	options.Insecure = insecure == "true"
+	for _, set := range sets {
+		if seconds, ok := number.Field(set["timeout"]); ok && seconds > 0 {
+			options.Timeout = time.Duration(seconds * float64(time.Second))
+			break
+		}
+	}
+	return options
+}
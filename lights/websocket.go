@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var (
+	hubsLock sync.Mutex
+	hubs     = make(map[hassConnection]*hassHub)
+)
+
+// hassHub keeps one WebSocket connection per Home Assistant instance,
+// subscribed to state_changed events, and fans each change out to the
+// subscribers of that entity. It reconnects until its last subscriber leaves.
+type hassHub struct {
+	conn        hassConnection
+	lock        sync.Mutex
+	subscribers map[string]map[*subscription]bool
+	ws          *websocket.Conn
+	quit        chan bool
+}
+
+type hassMessage struct {
+	Id          int             `json:"id,omitempty"`
+	Type        string          `json:"type"`
+	AccessToken string          `json:"access_token,omitempty"`
+	EventType   string          `json:"event_type,omitempty"`
+	Success     *bool           `json:"success,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Event       *struct {
+		EventType string `json:"event_type"`
+		Data      struct {
+			EntityId string       `json:"entity_id"`
+			NewState *entityState `json:"new_state"`
+		} `json:"data"`
+	} `json:"event,omitempty"`
+}
+
+const (
+	subscribeId = iota + 1
+	getStatesId
+)
+
+// subscribe starts watching an entity, opening the connection to its Home
+// Assistant instance if no other handler has.
+func (conn hassConnection) subscribe(entityId string) *subscription {
+	hubsLock.Lock()
+	defer hubsLock.Unlock()
+	hub, ok := hubs[conn]
+	if !ok {
+		hub = &hassHub{conn: conn, subscribers: make(map[string]map[*subscription]bool), quit: make(chan bool)}
+		hubs[conn] = hub
+		go hub.run()
+	}
+	sub := &subscription{C: make(chan entityState, 1)}
+	sub.close = func() { hub.unsubscribe(sub, entityId) }
+	hub.lock.Lock()
+	if hub.subscribers[entityId] == nil {
+		hub.subscribers[entityId] = make(map[*subscription]bool)
+	}
+	hub.subscribers[entityId][sub] = true
+	hub.lock.Unlock()
+	return sub
+}
+
+// unsubscribe removes a subscriber, and closes the connection if it was the
+// last one.
+func (hub *hassHub) unsubscribe(s *subscription, entityId string) {
+	hubsLock.Lock()
+	defer hubsLock.Unlock()
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	delete(hub.subscribers[entityId], s)
+	if len(hub.subscribers[entityId]) == 0 {
+		delete(hub.subscribers, entityId)
+	}
+	if len(hub.subscribers) > 0 {
+		return
+	}
+	delete(hubs, hub.conn)
+	close(hub.quit)
+	if hub.ws != nil {
+		hub.ws.Close()
+	}
+}
+
+func (h *hassHub) publish(state entityState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sub := range h.subscribers[state.EntityId] {
+		sub.deliver(state)
+	}
+}
+
+func (h *hassHub) run() {
+	delay := minReconnectDelay
+	for {
+		start := time.Now()
+		err := h.listen()
+		select {
+		case <-h.quit:
+			return
+		default:
+		}
+		log.Println("Home Assistant websocket:", err)
+		// A connection that stayed up for a while was healthy, so start backing
+		// off from scratch
+		if time.Since(start) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		select {
+		case <-h.quit:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// listen connects, authenticates and subscribes, then publishes state changes
+// until the connection drops.
+func (h *hassHub) listen() error {
+	dialer, err := h.conn.Transport.dialer()
+	if err != nil {
+		return err
+	}
+	ws, _, err := dialer.Dial(h.conn.websocketUrl(), nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	h.lock.Lock()
+	select {
+	case <-h.quit:
+		h.lock.Unlock()
+		return nil
+	default:
+	}
+	h.ws = ws
+	h.lock.Unlock()
+
+	var msg hassMessage
+	if err := ws.ReadJSON(&msg); err != nil {
+		return err
+	}
+	if msg.Type != "auth_required" {
+		return errors.New("unexpected message: " + msg.Type)
+	}
+	if err := ws.WriteJSON(hassMessage{Type: "auth", AccessToken: h.conn.ApiKey}); err != nil {
+		return err
+	}
+	msg = hassMessage{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		return err
+	}
+	if msg.Type != "auth_ok" {
+		return errors.New("authentication failed: " + msg.Message)
+	}
+	if err := ws.WriteJSON(hassMessage{Id: subscribeId, Type: "subscribe_events", EventType: "state_changed"}); err != nil {
+		return err
+	}
+	// Catch up on anything that changed while disconnected
+	if err := ws.WriteJSON(hassMessage{Id: getStatesId, Type: "get_states"}); err != nil {
+		return err
+	}
+	for {
+		msg = hassMessage{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			return err
+		}
+		switch {
+		case msg.Type == "event" && msg.Event != nil && msg.Event.Data.NewState != nil:
+			h.publish(*msg.Event.Data.NewState)
+		case msg.Type == "result" && msg.Success != nil && !*msg.Success:
+			return errors.New("request failed: " + string(msg.Result))
+		case msg.Type == "result" && msg.Id == getStatesId:
+			var states []entityState
+			if err := json.Unmarshal(msg.Result, &states); err != nil {
+				return err
+			}
+			for _, state := range states {
+				h.publish(state)
+			}
+		}
+	}
+}
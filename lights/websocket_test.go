@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeHass is a Home Assistant websocket API that walks through the
+// handshake, answers get_states from its states, and hands each connection to
+// the test so it can send events or drop it.
+type fakeHass struct {
+	t       *testing.T
+	token   string
+	lock    sync.Mutex
+	states  []entityState
+	conns   chan *websocket.Conn
+	server  *httptest.Server
+	upgrade websocket.Upgrader
+}
+
+func newFakeHass(t *testing.T, token string, states ...entityState) *fakeHass {
+	f := &fakeHass{t: t, token: token, states: states, conns: make(chan *websocket.Conn, 4)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeHass) connection() hassConnection {
+	return hassConnection{BaseUrl: f.server.URL, ApiKey: f.token, Transport: transportOptions{Timeout: time.Second}}
+}
+
+func (f *fakeHass) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/websocket" {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := f.upgrade.Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	ws.WriteJSON(hassMessage{Type: "auth_required"})
+	var msg hassMessage
+	if err := ws.ReadJSON(&msg); err != nil || msg.Type != "auth" {
+		f.t.Errorf("expected auth, got %+v (%v)", msg, err)
+		ws.Close()
+		return
+	}
+	if msg.AccessToken != f.token {
+		ws.WriteJSON(hassMessage{Type: "auth_invalid", Message: "Invalid access token"})
+		ws.Close()
+		return
+	}
+	ws.WriteJSON(hassMessage{Type: "auth_ok"})
+	for _, expected := range []string{"subscribe_events", "get_states"} {
+		msg = hassMessage{}
+		if err := ws.ReadJSON(&msg); err != nil || msg.Type != expected {
+			f.t.Errorf("expected %s, got %+v (%v)", expected, msg, err)
+			ws.Close()
+			return
+		}
+		if msg.Type == "subscribe_events" && msg.EventType != "state_changed" {
+			f.t.Errorf("subscribed to %q", msg.EventType)
+		}
+		success := true
+		f.lock.Lock()
+		result, _ := json.Marshal(f.states)
+		f.lock.Unlock()
+		if msg.Type == "subscribe_events" {
+			result = nil
+		}
+		ws.WriteJSON(hassMessage{Id: msg.Id, Type: "result", Success: &success, Result: result})
+	}
+	f.conns <- ws
+}
+
+func (f *fakeHass) setStates(states ...entityState) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.states = states
+}
+
+func (f *fakeHass) nextConn() *websocket.Conn {
+	select {
+	case ws := <-f.conns:
+		return ws
+	case <-time.After(5 * time.Second):
+		f.t.Fatal("no connection from the client")
+		return nil
+	}
+}
+
+func sendStateChanged(t *testing.T, ws *websocket.Conn, entityId string, state string) {
+	event := map[string]any{
+		"type": "event",
+		"event": map[string]any{
+			"event_type": "state_changed",
+			"data": map[string]any{
+				"entity_id": entityId,
+				"new_state": entityState{EntityId: entityId, State: state},
+			},
+		},
+	}
+	if err := ws.WriteJSON(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectState(t *testing.T, sub *subscription, entityId string, state string) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-sub.C:
+			if got.EntityId == entityId && got.State == state {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("%s never became %s", entityId, state)
+		}
+	}
+}
+
+func TestHubHandshakeAndCatchUp(t *testing.T) {
+	hass := newFakeHass(t, "token", entityState{EntityId: "light.desk", State: "on"})
+	sub := hass.connection().subscribe("light.desk")
+	defer sub.Close()
+	hass.nextConn()
+	expectState(t, sub, "light.desk", "on")
+}
+
+func TestHubFansOutToSubscribers(t *testing.T) {
+	hass := newFakeHass(t, "token")
+	conn := hass.connection()
+	first := conn.subscribe("light.desk")
+	defer first.Close()
+	second := conn.subscribe("light.desk")
+	defer second.Close()
+	other := conn.subscribe("light.hall")
+	defer other.Close()
+	ws := hass.nextConn()
+
+	sendStateChanged(t, ws, "light.desk", "off")
+	expectState(t, first, "light.desk", "off")
+	expectState(t, second, "light.desk", "off")
+	select {
+	case state := <-other.C:
+		t.Fatalf("light.hall subscriber got %+v", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case <-hass.conns:
+		t.Fatal("subscribers opened more than one connection")
+	default:
+	}
+}
+
+func TestHubReconnectsAfterDrop(t *testing.T) {
+	hass := newFakeHass(t, "token", entityState{EntityId: "light.desk", State: "on"})
+	sub := hass.connection().subscribe("light.desk")
+	defer sub.Close()
+	dropped := hass.nextConn()
+	expectState(t, sub, "light.desk", "on")
+
+	// The state changes while disconnected, so the client catches up from
+	// get_states, then carries on with events
+	hass.setStates(entityState{EntityId: "light.desk", State: "off"})
+	dropped.Close()
+	ws := hass.nextConn()
+	expectState(t, sub, "light.desk", "off")
+	sendStateChanged(t, ws, "light.desk", "on")
+	expectState(t, sub, "light.desk", "on")
+}
+
+func TestHubClosesWithLastSubscriber(t *testing.T) {
+	hass := newFakeHass(t, "token")
+	conn := hass.connection()
+	sub := conn.subscribe("light.desk")
+	ws := hass.nextConn()
+	sub.Close()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("connection still open after the last subscriber left")
+	}
+	hubsLock.Lock()
+	defer hubsLock.Unlock()
+	if _, ok := hubs[conn]; ok {
+		t.Fatal("hub still registered after the last subscriber left")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/number"
+)
+
+var confirmBackground = color.NRGBA{R: 0xc0, G: 0x39, B: 0x2b, A: 0xff}
+
+// confirmGuard arms instead of toggling when the command about to run needs
+// confirmation, and only runs it if pressed again before the countdown ends.
+type confirmGuard struct {
+	lock   sync.Mutex
+	disarm chan struct{}
+}
+
+// toggle handles a press or tap, which confirms the armed command.
+func (g *confirmGuard) toggle(cfg toggleConfig, info api.StreamDeckInfoV1, sharedStatus bool, display stateDisplay) {
+	g.run(cfg, info, sharedStatus, display, true)
+}
+
+// step handles a knob turn, which can arm the guard but never confirms it, so
+// turning the knob twice can't run a command that needs confirmation.
+func (g *confirmGuard) step(cfg toggleConfig, info api.StreamDeckInfoV1, sharedStatus bool, display stateDisplay) {
+	g.run(cfg, info, sharedStatus, display, false)
+}
+
+func (g *confirmGuard) run(cfg toggleConfig, info api.StreamDeckInfoV1, sharedStatus bool, display stateDisplay, confirm bool) {
+	timeout := confirmTimeout(cfg, sharedStatus)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.disarm != nil {
+		if !confirm {
+			return
+		}
+		close(g.disarm)
+		g.disarm = nil
+		toggle(cfg, info, sharedStatus, display)
+		return
+	}
+	if timeout <= 0 {
+		toggle(cfg, info, sharedStatus, display)
+		return
+	}
+	disarm := make(chan struct{})
+	g.disarm = disarm
+	go g.countdown(cfg, timeout, disarm, display)
+}
+
+// armed reports whether a command is waiting for a confirming press.
+func (g *confirmGuard) armed() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.disarm != nil
+}
+
+func (g *confirmGuard) countdown(cfg toggleConfig, timeout time.Duration, disarm chan struct{}, display stateDisplay) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for remaining := int(math.Ceil(timeout.Seconds())); remaining > 0; remaining = int(math.Ceil(time.Until(deadline).Seconds())) {
+		if display != nil {
+			display.ShowConfirm(cfg, remaining)
+		}
+		select {
+		case <-disarm:
+			if display != nil {
+				display.Redraw(cfg)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+	g.lock.Lock()
+	if g.disarm == disarm {
+		g.disarm = nil
+	}
+	g.lock.Unlock()
+	if display != nil {
+		display.Redraw(cfg)
+	}
+}
+
+// confirmTimeout is how long the command that moves away from the given state
+// waits for a confirming press, or 0 if it runs straight away.
+func confirmTimeout(cfg toggleConfig, sharedStatus bool) time.Duration {
+	index := "down_confirm_seconds"
+	if !sharedStatus {
+		index = "up_confirm_seconds"
+	}
+	seconds, ok := number.Field(cfg.ActionFields[index])
+	if !ok || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ShowConfirm replaces the icon with the confirmation prompt.
+func (c *ToggleIconHandler) ShowConfirm(cfg toggleConfig, remaining int) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	c.Callback(confirmImage(c.stateImage(cfg.status()).Bounds(), remaining))
+}
+
+func confirmImage(bounds image.Rectangle, remaining int) image.Image {
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, bounds, image.NewUniform(confirmBackground), image.Point{}, draw.Src)
+	prompt, err := api.DrawText(img, "Confirm?\n"+strconv.Itoa(remaining), api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          "bold",
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return prompt
+}
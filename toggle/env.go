@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/unix-streamdeck/api/v2"
+)
+
+var envNameSanitiser = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// commandEnv builds the environment handed to check and action commands, so one
+// script can serve many keys and decks without duplicating configuration.
+func commandEnv(t toggleConfig, info api.StreamDeckInfoV1, status bool) []string {
+	env := append(os.Environ(),
+		"SD_SERIAL="+info.Serial,
+		"SD_NAME="+info.Name,
+		"SD_PAGE="+strconv.Itoa(info.Page),
+		"SD_KEY="+keyId(t),
+		"SD_STATE="+stateName(status),
+	)
+	// Later maps win, so a key or knob handler field overrides an icon or LCD
+	// handler field of the same name, and shared fields override both.
+	fields := make(map[string]string)
+	for _, set := range []map[string]any{t.DisplayFields, t.ActionFields, t.SharedFields} {
+		for name, value := range set {
+			fields[envName(name)] = fieldString(value)
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, "SD_FIELD_"+name+"="+fields[name])
+	}
+	return env
+}
+
+// keyId identifies a key or knob to commands and to its saved state. The
+// handler API doesn't expose the key index, so a "key_id" shared field is used
+// if set, otherwise a short hash of the up and down commands, which identify
+// what the toggle controls and so survive edits to its labels, icons and
+// colours.
+func keyId(t toggleConfig) string {
+	if id, ok := t.SharedFields["key_id"]; ok && fieldString(id) != "" {
+		return fieldString(id)
+	}
+	up, _ := t.ActionFields["up_command"].(string)
+	down, _ := t.ActionFields["down_command"].(string)
+	sum := sha1.Sum([]byte(up + "\x00" + down))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func stateName(status bool) string {
+	if status {
+		return "up"
+	}
+	return "down"
+}
+
+func envName(name string) string {
+	return envNameSanitiser.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+func fieldString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
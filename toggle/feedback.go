@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+	"log"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/render"
+)
+
+// ShowFeedback outlines the icon with a label until the feedback expires.
+func (c *ToggleIconHandler) ShowFeedback(cfg toggleConfig, kind string, text string, until time.Time) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	flash(c.Callback, feedbackImage(c.stateImage(cfg.status()), kind, text), time.Until(until), func() image.Image {
+		if !c.Running {
+			return nil
+		}
+		return c.stateImage(cfg.status())
+	})
+}
+
+func feedbackImage(base image.Image, kind string, text string) image.Image {
+	colour := render.ErrorColour
+	if kind == "success" {
+		colour = render.SuccessColour
+		if text == "" {
+			text = "OK"
+		}
+	}
+	img := outline(base, colour)
+	if text == "" {
+		return img
+	}
+	labelled, err := api.DrawText(img, text, api.DrawTextOptions{
+		VerticalAlignment: api.Center,
+		FontFace:          "bold",
+		Colour:            render.HexColour(colour),
+	})
+	if err != nil {
+		log.Println(err)
+		return img
+	}
+	return labelled
+}
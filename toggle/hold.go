@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"time"
+
+	"streamdeckd-modules/internal/render"
+)
+
+// The handler API has no release or hold event, so a hold is recognised by
+// timing: the daemon calls Key again once a key has been held for KeyHold. A
+// second call is only taken as that notification if it arrives between
+// holdTolerance before and holdGrace after the threshold; earlier ones are
+// separate presses.
+const (
+	holdTolerance = 50 * time.Millisecond
+	holdGrace     = 250 * time.Millisecond
+)
+
+const holdFeedbackDuration = time.Second
+
+var defaultHoldColour = color.NRGBA{R: 0xff, G: 0x8c, A: 0xff}
+
+// press defers the tap until the hold threshold has passed, running the hold
+// instead if the daemon reports the key as still held by then.
+func (t *ToggleKeyHandler) press(threshold time.Duration, tap func(), onHold func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.pending != nil && t.pending.Stop() {
+		previous := t.pendingTap
+		t.pending, t.pendingTap = nil, nil
+		if time.Since(t.pressedAt) >= threshold-holdTolerance {
+			onHold()
+			return
+		}
+		// Pressed again before the threshold, so the first press was a tap
+		previous()
+		if t.guard.armed() {
+			// and armed the guard, which this press confirms
+			tap()
+			return
+		}
+	}
+	t.pressedAt = time.Now()
+	t.pendingTap = tap
+	var timer *time.Timer
+	timer = time.AfterFunc(threshold+holdGrace, func() {
+		t.lock.Lock()
+		if t.pending == timer {
+			t.pending, t.pendingTap = nil, nil
+		}
+		t.lock.Unlock()
+		tap()
+	})
+	t.pending = timer
+}
+
+// ShowHold briefly outlines the current icon to acknowledge a held key, then
+// restores it.
+func (c *ToggleIconHandler) ShowHold(cfg toggleConfig) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	flash(c.Callback, outline(c.stateImage(cfg.status()), holdColour(cfg)), holdFeedbackDuration, func() image.Image {
+		if !c.Running {
+			return nil
+		}
+		return c.stateImage(cfg.status())
+	})
+}
+
+// flash shows img for d, then redraws with whatever restore returns, unless
+// that is nil.
+func flash(callback func(image.Image), img image.Image, d time.Duration, restore func() image.Image) {
+	callback(img)
+	time.AfterFunc(d, func() {
+		if restored := restore(); restored != nil {
+			callback(restored)
+		}
+	})
+}
+
+func holdColour(cfg toggleConfig) color.NRGBA {
+	hex, ok := cfg.DisplayFields["hold_colour"].(string)
+	if !ok || hex == "" {
+		return defaultHoldColour
+	}
+	parsed, err := render.ParseColour(hex)
+	if err != nil {
+		log.Println(err)
+		return defaultHoldColour
+	}
+	return parsed
+}
+
+func outline(img image.Image, colour color.NRGBA) image.Image {
+	bounds := img.Bounds()
+	return render.Outline(img, colour, max(min(bounds.Dx(), bounds.Dy())/16, 2))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"golang.org/x/sync/semaphore"
+)
+
+// cycleStepInterval limits how often knob rotation can change state in cycle
+// mode, so a quick spin doesn't start a burst of commands.
+const cycleStepInterval = 500 * time.Millisecond
+
+type ToggleLcdHandler struct {
+	Running   bool
+	Lock      *semaphore.Weighted
+	Callback  func(image image.Image)
+	Quit      chan bool
+	UpBuff    image.Image
+	DownBuff  image.Image
+	FirstLoop bool
+	// statuses carries a stateless toggle's new state to the loop
+	statuses chan bool
+}
+
+func (c *ToggleLcdHandler) Start(knob api.KnobConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
+	if c.Lock == nil {
+		c.Lock = semaphore.NewWeighted(1)
+	}
+	if c.Quit == nil {
+		c.Quit = make(chan bool)
+	}
+	if c.statuses == nil {
+		c.statuses = make(chan bool, 1)
+	}
+	c.Callback = callback
+	if c.UpBuff == nil {
+		c.UpBuff = renderState("up", knob.LcdHandlerFields, info.LcdWidth, info.LcdHeight)
+	}
+	if c.DownBuff == nil {
+		c.DownBuff = renderState("down", knob.LcdHandlerFields, info.LcdWidth, info.LcdHeight)
+	}
+	c.FirstLoop = true
+	go c.loop(knob, info, callback)
+}
+
+func (c *ToggleLcdHandler) loop(knob api.KnobConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
+	ctx := context.Background()
+	err := c.Lock.Acquire(ctx, 1)
+	if err != nil {
+		return
+	}
+	defer c.Lock.Release(1)
+	watch(knobToggleConfig(knob), info, c.Quit, c.statuses, c.FirstLoop, c, func(status bool) {
+		c.FirstLoop = false
+		callback(c.stateImage(status))
+	})
+}
+
+func (c *ToggleLcdHandler) stateImage(status bool) image.Image {
+	if status {
+		return c.UpBuff
+	}
+	return c.DownBuff
+}
+
+// ShowHold briefly outlines the LCD segment to acknowledge a long tap, then
+// restores it.
+func (c *ToggleLcdHandler) ShowHold(cfg toggleConfig) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	flash(c.Callback, outline(c.stateImage(cfg.status()), holdColour(cfg)), holdFeedbackDuration, func() image.Image {
+		if !c.Running {
+			return nil
+		}
+		return c.stateImage(cfg.status())
+	})
+}
+
+// Redraw shows the LCD segment for the current state.
+func (c *ToggleLcdHandler) Redraw(cfg toggleConfig) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	c.Callback(c.stateImage(cfg.status()))
+}
+
+// ShowFeedback outlines the LCD segment with a label until the feedback
+// expires.
+func (c *ToggleLcdHandler) ShowFeedback(cfg toggleConfig, kind string, text string, until time.Time) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	flash(c.Callback, feedbackImage(c.stateImage(cfg.status()), kind, text), time.Until(until), func() image.Image {
+		if !c.Running {
+			return nil
+		}
+		return c.stateImage(cfg.status())
+	})
+}
+
+// ShowConfirm replaces the LCD segment with the confirmation prompt.
+func (c *ToggleLcdHandler) ShowConfirm(cfg toggleConfig, remaining int) {
+	if c.Callback == nil || !c.Running {
+		return
+	}
+	c.Callback(confirmImage(c.stateImage(cfg.status()).Bounds(), remaining))
+}
+
+func (c *ToggleLcdHandler) SetStatus(status bool) {
+	putStatus(c.statuses, status)
+}
+
+func (c *ToggleLcdHandler) IsRunning() bool {
+	return c.Running
+}
+
+func (c *ToggleLcdHandler) SetRunning(running bool) {
+	c.Running = running
+}
+
+func (c *ToggleLcdHandler) Stop() {
+	c.Running = false
+	c.Quit <- true
+}
+
+type ToggleKnobOrTouchHandler struct {
+	lock     sync.Mutex
+	lastStep time.Time
+	guard    confirmGuard
+}
+
+func (t *ToggleKnobOrTouchHandler) Input(knob api.KnobConfigV3, info api.StreamDeckInfoV1, event api.InputEvent) {
+	cfg := knobToggleConfig(knob)
+	display := knobDisplay(knob)
+	cfg.restore(info, display)
+	sharedStatus := cfg.status()
+	switch event.EventType {
+	case api.KNOB_PRESS, api.SCREEN_SHORT_TAP:
+		t.guard.toggle(cfg, info, sharedStatus, display)
+	case api.SCREEN_LONG_TAP:
+		holdCommand, _ := cfg.ActionFields[stateName(sharedStatus)+"_hold_command"].(string)
+		if holdCommand == "" {
+			return
+		}
+		if display != nil {
+			display.ShowHold(cfg)
+		}
+		hold(cfg, info, sharedStatus, holdCommand)
+	case api.KNOB_CW, api.KNOB_CCW:
+		if mode, _ := cfg.ActionFields["mode"].(string); mode != "cycle" {
+			return
+		}
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if time.Since(t.lastStep) < cycleStepInterval {
+			return
+		}
+		t.lastStep = time.Now()
+		// Two states, so stepping either way lands on the other one
+		t.guard.step(cfg, info, sharedStatus, display)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"image"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/render"
+)
+
+// A down state without its own image can be rendered by tinting the up image.
+var stateOptions = render.StateOptions{TintFrom: "up"}
+
+// RenderState builds the icon for a state ("up" or "down") from its background
+// colour, image and label, any of which may be left unset.
+func (c *ToggleIconHandler) RenderState(state string, k api.KeyConfigV3, info api.StreamDeckInfoV1) image.Image {
+	return renderState(state, k.IconHandlerFields, info.IconSize, info.IconSize)
+}
+
+func renderState(state string, fields map[string]any, width int, height int) image.Image {
+	return render.State(state, fields, width, height, stateOptions)
+}
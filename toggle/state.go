@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"time"
+
+	"github.com/unix-streamdeck/api/v2"
+	"streamdeckd-modules/internal/sharedstate"
+)
+
+// toggleConfig is the part of a key or knob config shared by the key and
+// Stream Deck+ variants of the toggle, so both run the same check and
+// command logic.
+type toggleConfig struct {
+	// DisplayFields are the icon or LCD handler fields
+	DisplayFields map[string]any
+	// ActionFields are the key or knob/touch handler fields
+	ActionFields map[string]any
+	SharedFields map[string]any
+	SharedState  map[string]any
+}
+
+func keyToggleConfig(k api.KeyConfigV3) toggleConfig {
+	return toggleConfig{
+		DisplayFields: k.IconHandlerFields,
+		ActionFields:  k.KeyHandlerFields,
+		SharedFields:  k.SharedHandlerFields,
+		SharedState:   k.SharedState,
+	}
+}
+
+func knobToggleConfig(k api.KnobConfigV3) toggleConfig {
+	return toggleConfig{
+		DisplayFields: k.LcdHandlerFields,
+		ActionFields:  k.KnobOrTouchHandlerFields,
+		SharedFields:  k.SharedHandlerFields,
+		SharedState:   k.SharedState,
+	}
+}
+
+// stateDisplay is implemented by the icon and LCD handlers, so the key and
+// knob/touch handlers can draw transient feedback over the current state.
+type stateDisplay interface {
+	ShowHold(cfg toggleConfig)
+	ShowConfirm(cfg toggleConfig, remaining int)
+	ShowFeedback(cfg toggleConfig, kind string, text string, until time.Time)
+	Redraw(cfg toggleConfig)
+	// SetStatus hands a stateless toggle's new state to the display's loop,
+	// which owns the shared state
+	SetStatus(status bool)
+}
+
+// keyDisplay returns the key's Toggle icon handler, or nil if another icon
+// handler is in use.
+func keyDisplay(k api.KeyConfigV3) stateDisplay {
+	if handler, ok := k.IconHandlerStruct.(*ToggleIconHandler); ok && k.IconHandler == "Toggle" {
+		return handler
+	}
+	return nil
+}
+
+// knobDisplay returns the knob's Toggle LCD handler, or nil if another LCD
+// handler is in use.
+func knobDisplay(k api.KnobConfigV3) stateDisplay {
+	if handler, ok := k.LcdHandlerStruct.(*ToggleLcdHandler); ok && k.LcdHandler == "Toggle" {
+		return handler
+	}
+	return nil
+}
+
+func (t toggleConfig) status() bool {
+	value, _ := sharedstate.Get(t.SharedState, "status")
+	status, _ := value.(bool)
+	return status
+}
+
+// stateless reports whether the toggle tracks its own state rather than
+// running a check command.
+func (t toggleConfig) stateless() bool {
+	command, ok := t.DisplayFields["check_command"].(string)
+	return !ok || command == ""
+}
+
+// restore loads the persisted state of a stateless toggle for a key or knob
+// without a Toggle display, whose loop would otherwise have loaded it.
+func (t toggleConfig) restore(info api.StreamDeckInfoV1, display stateDisplay) {
+	if display != nil || !t.stateless() {
+		return
+	}
+	if _, ok := sharedstate.Get(t.SharedState, "status"); ok {
+		return
+	}
+	status, err := loadStatus(t, info)
+	if err != nil {
+		log.Println(err)
+	}
+	sharedstate.Set(t.SharedState, "status", status)
+}
+
+// watch runs the check command until quit receives, calling render whenever
+// the state changes, and on the first run if firstLoop is set. Stateless
+// toggles restore their persisted state, and render when a press sends a new
+// one on statuses. Feedback left in the shared state by another module's key
+// handler is shown on the display.
+func watch(t toggleConfig, info api.StreamDeckInfoV1, quit chan bool, statuses chan bool, firstLoop bool, display stateDisplay, render func(status bool)) {
+	if t.stateless() {
+		status, err := loadStatus(t, info)
+		if err != nil {
+			log.Println(err)
+		}
+		sharedstate.Set(t.SharedState, "status", status)
+	}
+	var lastFeedback time.Time
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if kind, text, until, ok := sharedFeedback(t); ok && !until.Equal(lastFeedback) {
+			lastFeedback = until
+			display.ShowFeedback(t, kind, text, until)
+		}
+		sharedStatus := t.status()
+		status := sharedStatus
+		if !t.stateless() {
+			status = check(t, info, sharedStatus)
+		}
+		if status != sharedStatus || firstLoop {
+			sharedstate.Set(t.SharedState, "status", status)
+			firstLoop = false
+			render(status)
+		}
+		select {
+		case <-quit:
+			return
+		case status := <-statuses:
+			if t.stateless() {
+				sharedstate.Set(t.SharedState, "status", status)
+				render(status)
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// putStatus replaces any state still waiting to be picked up by a loop, as
+// only the newest one matters.
+func putStatus(statuses chan bool, status bool) {
+	for statuses != nil {
+		select {
+		case statuses <- status:
+			return
+		default:
+		}
+		select {
+		case <-statuses:
+		default:
+		}
+	}
+}
+
+// sharedFeedback reads the feedback a key handler, such as the Lights one,
+// left for the icon handler to draw: a map with a "kind" of "error" or
+// "success", a short "text" label, and the time.Time to show it "until".
+func sharedFeedback(t toggleConfig) (string, string, time.Time, bool) {
+	value, _ := sharedstate.Get(t.SharedState, "feedback")
+	feedback, ok := value.(map[string]any)
+	if !ok {
+		return "", "", time.Time{}, false
+	}
+	until, ok := feedback["until"].(time.Time)
+	if !ok || time.Now().After(until) {
+		return "", "", time.Time{}, false
+	}
+	kind, _ := feedback["kind"].(string)
+	text, _ := feedback["text"].(string)
+	return kind, text, until, true
+}
+
+// check runs the check command, which reports "up" by exiting successfully.
+func check(t toggleConfig, info api.StreamDeckInfoV1, sharedStatus bool) bool {
+	cmd := exec.Command("/bin/sh", "-c", t.DisplayFields["check_command"].(string))
+	cmd.Env = commandEnv(t, info, sharedStatus)
+	if err := cmd.Start(); err != nil {
+		//log.Println(err)
+		return false
+	}
+	err := cmd.Wait()
+	if err != nil {
+		//log.Printf("command failed: %s", err)
+		return false
+	}
+	return true
+}
+
+// toggle runs the up or down command to move away from the given state.
+// Stateless toggles flip and persist their state straight away, through the
+// display's loop if there is one.
+func toggle(t toggleConfig, info api.StreamDeckInfoV1, sharedStatus bool, display stateDisplay) {
+	index := "down_command"
+	if !sharedStatus {
+		index = "up_command"
+	}
+	if command, ok := t.ActionFields[index].(string); ok && command != "" {
+		runCommand(command, append(commandEnv(t, info, sharedStatus), "SD_ACTION=tap"))
+	}
+	if !t.stateless() {
+		return
+	}
+	if display != nil {
+		display.SetStatus(!sharedStatus)
+	} else {
+		sharedstate.Set(t.SharedState, "status", !sharedStatus)
+	}
+	if err := saveStatus(t, info, !sharedStatus); err != nil {
+		log.Println(err)
+	}
+}
+
+func hold(t toggleConfig, info api.StreamDeckInfoV1, sharedStatus bool, holdCommand string) {
+	runCommand(holdCommand, append(commandEnv(t, info, sharedStatus), "SD_ACTION=hold"))
+}
+
+func runCommand(commandString string, env []string) {
+	go func() {
+		cmd := exec.Command("/bin/sh", commandString)
+		cmd.Env = env
+
+		if err := cmd.Start(); err != nil {
+			log.Println("There was a problem running ", commandString, ":", err)
+		} else {
+			pid := cmd.Process.Pid
+			err := cmd.Process.Release()
+			if err != nil {
+				log.Println(err)
+			}
+			log.Println(commandString, " has been started with pid", pid)
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/unix-streamdeck/api/v2"
+)
+
+// Toggles without a check command track their own state, which is kept under
+// $XDG_STATE_HOME so it survives a daemon restart, named by the key's SD_KEY.
+
+func stateFile(t toggleConfig, info api.StreamDeckInfoV1) (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	serial := strings.ReplaceAll(info.Serial, string(filepath.Separator), "_")
+	if serial == "" {
+		serial = "unknown"
+	}
+	return filepath.Join(dir, "streamdeckd", "toggle", serial, strconv.Itoa(info.Page), keyId(t)), nil
+}
+
+func loadStatus(t toggleConfig, info api.StreamDeckInfoV1) (bool, error) {
+	path, err := stateFile(t, info)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == stateName(true), nil
+}
+
+func saveStatus(t toggleConfig, info api.StreamDeckInfoV1, status bool) error {
+	path, err := stateFile(t, info)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(stateName(status)+"\n"), 0600)
+}
@@ -3,9 +3,7 @@ package main
 import (
 	"context"
 	"image"
-	"log"
-	"os"
-	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/unix-streamdeck/api/v2"
@@ -21,6 +19,8 @@ type ToggleIconHandler struct {
 	UpIconBuff   image.Image
 	DownIconBuff image.Image
 	FirstLoop    bool
+	// statuses carries a stateless toggle's new state to the loop
+	statuses chan bool
 }
 
 func (c *ToggleIconHandler) Start(k api.KeyConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
@@ -30,84 +30,50 @@ func (c *ToggleIconHandler) Start(k api.KeyConfigV3, info api.StreamDeckInfoV1,
 	if c.Quit == nil {
 		c.Quit = make(chan bool)
 	}
+	if c.statuses == nil {
+		c.statuses = make(chan bool, 1)
+	}
+	c.Callback = callback
 	if c.UpIconBuff == nil {
-		c.UpIconBuff = c.GetImage("up_icon", k, info)
+		c.UpIconBuff = c.RenderState("up", k, info)
 	}
 	if c.DownIconBuff == nil {
-		c.DownIconBuff = c.GetImage("down_icon", k, info)
+		c.DownIconBuff = c.RenderState("down", k, info)
 	}
 	c.FirstLoop = true
-	go c.loop(k, callback)
-}
-
-func (c *ToggleIconHandler) GetImage(index string, k api.KeyConfigV3, info api.StreamDeckInfoV1) image.Image {
-	path, ok := k.IconHandlerFields[index]
-	if !ok {
-		log.Println("image missing: " + index)
-		return image.NewNRGBA(image.Rect(0, 0, info.IconSize, info.IconSize))
-	}
-	f, err := os.Open(path.(string))
-	defer f.Close()
-	if err != nil {
-		log.Println(err)
-		return image.NewNRGBA(image.Rect(0, 0, info.IconSize, info.IconSize))
-	}
-	img, _, err := image.Decode(f)
-	if err != nil {
-		log.Println(err)
-		return image.NewNRGBA(image.Rect(0, 0, info.IconSize, info.IconSize))
-	}
-	return api.ResizeImage(img, info.IconSize)
+	go c.loop(k, info, callback)
 }
 
-func (c *ToggleIconHandler) loop(k api.KeyConfigV3, callback func(image image.Image)) {
+func (c *ToggleIconHandler) loop(k api.KeyConfigV3, info api.StreamDeckInfoV1, callback func(image image.Image)) {
 	ctx := context.Background()
 	err := c.Lock.Acquire(ctx, 1)
 	if err != nil {
 		return
 	}
 	defer c.Lock.Release(1)
-	for {
-		select {
-		case <-c.Quit:
-			return
-		default:
-			command, ok := k.IconHandlerFields["check_command"]
-
-			if !ok {
-				break
-			}
-			cmd := exec.Command("/bin/sh", "-c", command.(string))
-			status := true
-			if err := cmd.Start(); err != nil {
-				//log.Println(err)
-				status = false
-			}
-			err := cmd.Wait()
-			if err != nil {
-				//log.Println(command)
-				//log.Printf("command failed: %s", err)
-				status = false
-			}
-			sharedStatus, ok := k.SharedState["status"].(bool)
-			if !ok {
-				sharedStatus = false
-			}
-			if status == sharedStatus && !c.FirstLoop {
-				time.Sleep(250 * time.Millisecond)
-				continue
-			}
-			sharedStatus = status
-			k.SharedState["status"] = sharedStatus
-			c.FirstLoop = false
-			img := c.UpIconBuff
-			if sharedStatus == false {
-				img = c.DownIconBuff
-			}
-			callback(img)
-			time.Sleep(250 * time.Millisecond)
-		}
+	watch(keyToggleConfig(k), info, c.Quit, c.statuses, c.FirstLoop, c, func(status bool) {
+		c.FirstLoop = false
+		callback(c.stateImage(status))
+	})
+}
+
+func (c *ToggleIconHandler) stateImage(status bool) image.Image {
+	if status {
+		return c.UpIconBuff
+	}
+	return c.DownIconBuff
+}
+
+// Redraw shows the icon for the current state.
+func (c *ToggleIconHandler) Redraw(cfg toggleConfig) {
+	if c.Callback == nil || !c.Running {
+		return
 	}
+	c.Callback(c.stateImage(cfg.status()))
+}
+
+func (c *ToggleIconHandler) SetStatus(status bool) {
+	putStatus(c.statuses, status)
 }
 
 func (c *ToggleIconHandler) IsRunning() bool {
@@ -123,33 +89,62 @@ func (c *ToggleIconHandler) Stop() {
 	c.Quit <- true
 }
 
-type ToggleKeyHandler struct{}
+type ToggleKeyHandler struct {
+	// lock guards the press waiting to find out whether it is a hold
+	lock       sync.Mutex
+	pending    *time.Timer
+	pendingTap func()
+	pressedAt  time.Time
+	guard      confirmGuard
+}
 
-func (ToggleKeyHandler) Key(key api.KeyConfigV3, info api.StreamDeckInfoV1) {
-	sharedStatus := key.SharedState["status"].(bool)
-	index := "down_command"
-	if !sharedStatus {
-		index = "up_command"
-	}
-	command, ok := key.KeyHandlerFields[index]
-	commandString := command.(string)
-	if !ok {
+func (t *ToggleKeyHandler) Key(key api.KeyConfigV3, info api.StreamDeckInfoV1) {
+	cfg := keyToggleConfig(key)
+	display := keyDisplay(key)
+	cfg.restore(info, display)
+	sharedStatus := cfg.status()
+	holdCommand, _ := key.KeyHandlerFields[stateName(sharedStatus)+"_hold_command"].(string)
+	// The state is read when the tap runs, as an earlier tap may have changed
+	// it in the meantime
+	tap := func() { t.guard.toggle(cfg, info, cfg.status(), display) }
+	// While armed, a press confirms rather than starting a hold
+	if key.KeyHold <= 0 || holdCommand == "" || t.guard.armed() {
+		tap()
 		return
 	}
-	go func() {
-		cmd := exec.Command("/bin/sh", commandString)
-
-		if err := cmd.Start(); err != nil {
-			log.Println("There was a problem running ", commandString, ":", err)
-		} else {
-			pid := cmd.Process.Pid
-			err := cmd.Process.Release()
-			if err != nil {
-				log.Println(err)
-			}
-			log.Println(commandString, " has been started with pid", pid)
+	t.press(time.Duration(key.KeyHold)*time.Millisecond, tap, func() {
+		if display != nil {
+			display.ShowHold(cfg)
 		}
-	}()
+		hold(cfg, info, sharedStatus, holdCommand)
+	})
+}
+
+// displayFields configure the icon and LCD handlers, actionFields the key and
+// knob/touch handlers.
+var displayFields = []api.Field{
+	{Title: "Up Icon", Name: "up_icon", Type: api.File, FileTypes: []string{".png", ".jpg", ".jpeg"}},
+	{Title: "Down Icon", Name: "down_icon", Type: api.File, FileTypes: []string{".png", ".jpg", ".jpeg"}},
+	{Title: "Up Label", Name: "up_label", Type: api.Text},
+	{Title: "Up Background", Name: "up_background", Type: api.Colour},
+	{Title: "Up Text Colour", Name: "up_text_colour", Type: api.Colour},
+	{Title: "Down Label", Name: "down_label", Type: api.Text},
+	{Title: "Down Background", Name: "down_background", Type: api.Colour},
+	{Title: "Down Text Colour", Name: "down_text_colour", Type: api.Colour},
+	{Title: "Down Tint", Name: "down_tint", Type: api.Colour},
+	{Title: "Font Face", Name: "font_face", Type: api.FontFace},
+	{Title: "Label Alignment", Name: "label_alignment", Type: api.TextAlignment},
+	{Title: "Hold Colour", Name: "hold_colour", Type: api.Colour},
+	{Title: "Check Command", Name: "check_command", Type: api.Text},
+}
+
+var actionFields = []api.Field{
+	{Title: "Up Command", Name: "up_command", Type: api.Text},
+	{Title: "Down Command", Name: "down_command", Type: api.Text},
+	{Title: "Hold Command (Up State)", Name: "up_hold_command", Type: api.Text},
+	{Title: "Hold Command (Down State)", Name: "down_hold_command", Type: api.Text},
+	{Title: "Confirm Up Command (Seconds)", Name: "up_confirm_seconds", Type: api.Number},
+	{Title: "Confirm Down Command (Seconds)", Name: "down_confirm_seconds", Type: api.Number},
 }
 
 func GetModule() api.Module {
@@ -159,15 +154,16 @@ func GetModule() api.Module {
 		NewIcon: func() api.IconHandler {
 			return &ToggleIconHandler{Running: true, Lock: semaphore.NewWeighted(1), FirstLoop: true}
 		},
-		NewKey: func() api.KeyHandler { return &ToggleKeyHandler{} },
-		IconFields: []api.Field{
-			{Title: "Up Icon", Name: "up_icon", Type: api.File, FileTypes: []string{".png", ".jpg", ".jpeg"}},
-			{Title: "Down Icon", Name: "down_icon", Type: api.File, FileTypes: []string{".png", ".jpg", ".jpeg"}},
-			{Title: "Check Command", Name: "check_command", Type: api.Text},
-		},
-		KeyFields: []api.Field{
-			{Title: "Up Command", Name: "up_command", Type: api.Text},
-			{Title: "Down Command", Name: "down_command", Type: api.Text},
+		NewKey:     func() api.KeyHandler { return &ToggleKeyHandler{} },
+		IconFields: displayFields,
+		KeyFields:  actionFields,
+		NewLcd: func() api.LcdHandler {
+			return &ToggleLcdHandler{Running: true, Lock: semaphore.NewWeighted(1), FirstLoop: true}
 		},
+		LcdFields:      displayFields,
+		NewKnobOrTouch: func() api.KnobOrTouchHandler { return &ToggleKnobOrTouchHandler{} },
+		KnobOrTouchFields: append(actionFields,
+			api.Field{Title: "Mode", Name: "mode", Type: api.Select, ListItems: []string{"toggle", "cycle"}},
+		),
 	}
 }